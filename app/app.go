@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/joho/godotenv"
@@ -12,28 +13,146 @@ import (
 	"github.com/tailscale/hujson"
 )
 
+const (
+	// ConcurrencyAllow runs the job even if a previous run is still in progress.
+	ConcurrencyAllow = "allow"
+	// ConcurrencySkip skips the run if a previous run is still in progress.
+	ConcurrencySkip = "skip"
+	// ConcurrencyQueue waits for the previous run to complete.
+	ConcurrencyQueue = "queue"
+)
+
+const (
+	// CatchupNone skips the runs missed while smallweb was not running.
+	CatchupNone = "none"
+	// CatchupOnce runs the job once if any run was missed.
+	CatchupOnce = "once"
+	// CatchupAll runs every missed run, up to the catch-up limit.
+	CatchupAll = "all"
+)
+
 type CronJob struct {
-	Name        string   `json:"name"`
-	Description string   `json:"description"`
-	Schedule    string   `json:"schedule"`
-	Args        []string `json:"args"`
+	Name         string            `json:"name"`
+	Description  string            `json:"description"`
+	Schedule     string            `json:"schedule"`
+	Timezone     string            `json:"timezone,omitempty"`
+	Args         []string          `json:"args"`
+	Path         string            `json:"path,omitempty"`
+	Method       string            `json:"method,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	Body         string            `json:"body,omitempty"`
+	Timeout      Duration          `json:"timeout,omitempty"`
+	Concurrency  string            `json:"concurrency,omitempty"`
+	Retries      int               `json:"retries,omitempty"`
+	RetryDelay   Duration          `json:"retryDelay,omitempty"`
+	Catchup      string            `json:"catchup,omitempty"`
+	CatchupLimit int               `json:"catchupLimit,omitempty"`
+}
+
+// RateLimit caps the requests an app accepts. Zero values inherit the
+// global defaults, and negative values disable the limit.
+type RateLimit struct {
+	RequestsPerSecond     float64 `json:"requestsPerSecond,omitempty"`
+	Burst                 int     `json:"burst,omitempty"`
+	MaxConcurrentRequests int     `json:"maxConcurrentRequests,omitempty"`
+	QueueSize             int     `json:"queueSize,omitempty"`
+}
+
+// Merge fills the unset fields using the defaults.
+func (me RateLimit) Merge(defaults RateLimit) RateLimit {
+	if me.RequestsPerSecond == 0 {
+		me.RequestsPerSecond = defaults.RequestsPerSecond
+	}
+
+	if me.Burst == 0 {
+		me.Burst = defaults.Burst
+	}
+
+	if me.MaxConcurrentRequests == 0 {
+		me.MaxConcurrentRequests = defaults.MaxConcurrentRequests
+	}
+
+	if me.QueueSize == 0 {
+		me.QueueSize = defaults.QueueSize
+	}
+
+	return me
+}
+
+// Resources caps the resources used by the app worker. The memory and cpu
+// caps are only enforced on linux, when smallweb has access to a delegated
+// cgroup.
+type Resources struct {
+	// MaxHeapSize is the maximum size of the V8 heap, in megabytes.
+	MaxHeapSize int `json:"maxHeapSize,omitempty"`
+	// MaxMemory is the maximum memory of the worker process, in megabytes.
+	MaxMemory int `json:"maxMemory,omitempty"`
+	// MaxCPU is the maximum number of cpus used by the worker process, such
+	// as 0.5 for half a cpu.
+	MaxCPU float64 `json:"maxCpu,omitempty"`
 }
 
 type AppConfig struct {
-	Entrypoint    string    `json:"entrypoint,omitempty"`
-	Root          string    `json:"root,omitempty"`
-	Private       bool      `json:"private,omitempty"`
-	PublicRoutes  []string  `json:"publicRoutes,omitempty"`
-	PrivateRoutes []string  `json:"privateRoutes,omitempty"`
-	Crons         []CronJob `json:"crons,omitempty"`
+	Entrypoint       string      `json:"entrypoint,omitempty"`
+	Root             string      `json:"root,omitempty"`
+	Private          bool        `json:"private,omitempty"`
+	PublicRoutes     []string    `json:"publicRoutes,omitempty"`
+	PrivateRoutes    []string    `json:"privateRoutes,omitempty"`
+	AuthorizedEmails []string    `json:"authorizedEmails,omitempty"`
+	AuthorizedGroups []string    `json:"authorizedGroups,omitempty"`
+	Crons            []CronJob   `json:"crons,omitempty"`
+	Permissions      Permissions `json:"permissions,omitempty"`
+	RateLimit        RateLimit   `json:"rateLimit,omitempty"`
+	Timeouts         Timeouts    `json:"timeouts,omitempty"`
+	Resources        Resources   `json:"resources,omitempty"`
+}
+
+// cronJobNameRegexp matches the valid cron job names. They are used in cron
+// job ids (app:job) and file paths, so they are kept to a safe subset.
+var cronJobNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// Validate checks the fields of the config which can not be checked when
+// unmarshaling it.
+func (me AppConfig) Validate() error {
+	names := make(map[string]bool)
+	for _, job := range me.Crons {
+		if !cronJobNameRegexp.MatchString(job.Name) {
+			return fmt.Errorf("invalid cron job name %q: only letters, digits, dots, dashes and underscores are allowed", job.Name)
+		}
+
+		if names[job.Name] {
+			return fmt.Errorf("duplicate cron job name %q", job.Name)
+		}
+		names[job.Name] = true
+	}
+
+	for _, pattern := range me.AuthorizedEmails {
+		if err := ValidateEmailPattern(pattern); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ValidateEmailPattern checks that the pattern is either an email, or a
+// wildcard matching every email of a domain, such as *@example.com.
+func ValidateEmailPattern(pattern string) error {
+	local, domain, ok := strings.Cut(pattern, "@")
+	if !ok || local == "" || domain == "" || strings.ContainsAny(domain, "@*") || (local != "*" && strings.Contains(local, "*")) {
+		return fmt.Errorf("invalid email pattern %q: use an email or *@<domain>", pattern)
+	}
+
+	return nil
 }
 
 type App struct {
-	Name   string            `json:"name"`
-	Dir    string            `json:"dir"`
-	Url    string            `json:"url"`
-	Env    map[string]string `json:"-"`
-	Config AppConfig         `json:"config"`
+	Name    string            `json:"name"`
+	Dir     string            `json:"dir"`
+	Url     string            `json:"url"`
+	Domains []string          `json:"domains,omitempty"`
+	Env     map[string]string `json:"-"`
+	Config  AppConfig         `json:"config"`
 }
 
 func (me *App) Root() string {
@@ -67,6 +186,19 @@ func ListApps(rootDir string) ([]string, error) {
 }
 
 func LoadApp(dir string, domain string) (App, error) {
+	app, err := loadApp(dir, domain)
+	if err != nil {
+		return App{}, err
+	}
+
+	if err := app.Config.Validate(); err != nil {
+		return App{}, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return app, nil
+}
+
+func loadApp(dir string, domain string) (App, error) {
 	name := filepath.Base(dir)
 
 	app := App{
@@ -76,6 +208,15 @@ func LoadApp(dir string, domain string) (App, error) {
 		Env:  make(map[string]string),
 	}
 
+	if cnamePath := filepath.Join(dir, "CNAME"); utils.FileExists(cnamePath) {
+		domains, err := readCNAME(cnamePath)
+		if err != nil {
+			return App{}, fmt.Errorf("could not read CNAME: %v", err)
+		}
+
+		app.Domains = domains
+	}
+
 	if dotenvPath := filepath.Join(dir, ".env"); utils.FileExists(dotenvPath) {
 		dotenv, err := godotenv.Read(dotenvPath)
 		if err != nil {
@@ -172,6 +313,26 @@ func LoadApp(dir string, domain string) (App, error) {
 	return app, nil
 }
 
+// readCNAME reads the custom domains of an app, one per line.
+func readCNAME(cnamePath string) ([]string, error) {
+	content, err := os.ReadFile(cnamePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var domains []string
+	for _, line := range strings.Split(string(content), "\n") {
+		domain := strings.ToLower(strings.TrimSpace(line))
+		if domain == "" || strings.HasPrefix(domain, "#") {
+			continue
+		}
+
+		domains = append(domains, strings.TrimSuffix(domain, "."))
+	}
+
+	return domains, nil
+}
+
 func (me App) Entrypoint() string {
 	if strings.HasPrefix(me.Config.Entrypoint, "smallweb:") {
 		return me.Config.Entrypoint
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAppConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		crons   []CronJob
+		wantErr bool
+	}{
+		{name: "valid names", crons: []CronJob{{Name: "daily-task"}, {Name: "backup_v1.2"}}},
+		{name: "empty name", crons: []CronJob{{Name: ""}}, wantErr: true},
+		{name: "path traversal", crons: []CronJob{{Name: "../../../etc/cron"}}, wantErr: true},
+		{name: "slash", crons: []CronJob{{Name: "daily/task"}}, wantErr: true},
+		{name: "colon", crons: []CronJob{{Name: "daily:task"}}, wantErr: true},
+		{name: "leading dot", crons: []CronJob{{Name: ".hidden"}}, wantErr: true},
+		{name: "duplicate names", crons: []CronJob{{Name: "daily"}, {Name: "daily"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := AppConfig{Crons: tt.crons}.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateEmailPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		wantErr bool
+	}{
+		{pattern: "alice@example.com"},
+		{pattern: "*@example.com"},
+		{pattern: "*example.com", wantErr: true},
+		{pattern: "*.example.com", wantErr: true},
+		{pattern: "a*@example.com", wantErr: true},
+		{pattern: "*@*.example.com", wantErr: true},
+		{pattern: "*", wantErr: true},
+		{pattern: "*@", wantErr: true},
+		{pattern: "alice", wantErr: true},
+		{pattern: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			err := ValidateEmailPattern(tt.pattern)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error: %v", err, tt.wantErr)
+			}
+
+			if err := (AppConfig{AuthorizedEmails: []string{tt.pattern}}).Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("app config: got error %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadAppValidatesConfig(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "example")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "smallweb.json"), []byte(`{"crons": [{"name": "../escape", "schedule": "@daily"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadApp(dir, "example.com"); err == nil {
+		t.Error("expected an error for an invalid cron job name")
+	}
+}
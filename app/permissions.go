@@ -0,0 +1,361 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/pomdtr/smallweb/utils"
+)
+
+// Permission is either a boolean, granting or denying access to every
+// resource of a kind, or a list of resources the app can access.
+type Permission struct {
+	All    bool
+	Values []string
+}
+
+func (me *Permission) UnmarshalJSON(data []byte) error {
+	var all bool
+	if err := json.Unmarshal(data, &all); err == nil {
+		me.All = all
+		me.Values = nil
+		return nil
+	}
+
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("permission must be a boolean or a list of strings")
+	}
+
+	me.All = false
+	me.Values = values
+	return nil
+}
+
+func (me Permission) MarshalJSON() ([]byte, error) {
+	if me.All || len(me.Values) == 0 {
+		return json.Marshal(me.All)
+	}
+
+	return json.Marshal(me.Values)
+}
+
+// Permissions maps onto the deno --allow-* flags. Read and write access to
+// the app root is always granted, the read and write fields only list
+// additional paths.
+type Permissions struct {
+	Net   *Permission `json:"net,omitempty"`
+	Env   *Permission `json:"env,omitempty"`
+	Sys   *Permission `json:"sys,omitempty"`
+	Read  *Permission `json:"read,omitempty"`
+	Write *Permission `json:"write,omitempty"`
+	Run   *Permission `json:"run,omitempty"`
+	Ffi   *Permission `json:"ffi,omitempty"`
+}
+
+// Denials lists the resources an app can never access, whatever its
+// permissions. They map onto the deno --deny-* flags.
+type Denials struct {
+	Net   []string `json:"net,omitempty"`
+	Env   []string `json:"env,omitempty"`
+	Sys   []string `json:"sys,omitempty"`
+	Read  []string `json:"read,omitempty"`
+	Write []string `json:"write,omitempty"`
+	Run   []string `json:"run,omitempty"`
+	Ffi   []string `json:"ffi,omitempty"`
+}
+
+// PermissionError is returned when an app requests a permission exceeding
+// the global config.
+type PermissionError struct {
+	Flag   string
+	Denied bool
+}
+
+func (me *PermissionError) Error() string {
+	if me.Denied {
+		return fmt.Sprintf("app requests %s, which is denied by the global config", me.Flag)
+	}
+
+	return fmt.Sprintf("app requests %s, which is not allowed by the global config", me.Flag)
+}
+
+// DefaultPermissions are used for the fields missing from the app config.
+// They are also the default value of the global permissions ceiling.
+var DefaultPermissions = Permissions{
+	Net:   &Permission{All: true},
+	Env:   &Permission{All: true},
+	Sys:   &Permission{Values: []string{"osRelease", "homedir", "cpus", "hostname"}},
+	Read:  &Permission{},
+	Write: &Permission{},
+	Run:   &Permission{},
+	Ffi:   &Permission{},
+}
+
+type permissionKind struct {
+	name   string
+	isPath bool
+	// match reports whether the value is covered by the pattern
+	match      func(pattern string, value string) bool
+	permission func(p *Permissions) **Permission
+	denials    func(d *Denials) *[]string
+}
+
+var permissionKinds = []permissionKind{
+	{"net", false, matchHost, func(p *Permissions) **Permission { return &p.Net }, func(d *Denials) *[]string { return &d.Net }},
+	{"env", false, matchWildcard, func(p *Permissions) **Permission { return &p.Env }, func(d *Denials) *[]string { return &d.Env }},
+	{"sys", false, matchExact, func(p *Permissions) **Permission { return &p.Sys }, func(d *Denials) *[]string { return &d.Sys }},
+	{"read", true, matchPath, func(p *Permissions) **Permission { return &p.Read }, func(d *Denials) *[]string { return &d.Read }},
+	{"write", true, matchPath, func(p *Permissions) **Permission { return &p.Write }, func(d *Denials) *[]string { return &d.Write }},
+	{"run", false, matchExact, func(p *Permissions) **Permission { return &p.Run }, func(d *Denials) *[]string { return &d.Run }},
+	{"ffi", true, matchPath, func(p *Permissions) **Permission { return &p.Ffi }, func(d *Denials) *[]string { return &d.Ffi }},
+}
+
+// Merge fills the fields missing from me with the ones from defaults.
+func (me Permissions) Merge(defaults Permissions) Permissions {
+	for _, kind := range permissionKinds {
+		field := kind.permission(&me)
+		if *field != nil {
+			continue
+		}
+
+		if value := *kind.permission(&defaults); value != nil {
+			*field = value
+		} else {
+			*field = &Permission{}
+		}
+	}
+
+	return me
+}
+
+// Resolve makes the paths of the read, write and ffi permissions absolute,
+// relative paths being resolved from dir.
+func (me Permissions) Resolve(dir string) Permissions {
+	for _, kind := range permissionKinds {
+		field := kind.permission(&me)
+		if !kind.isPath || *field == nil || (*field).All {
+			continue
+		}
+
+		*field = &Permission{Values: resolvePaths((*field).Values, dir)}
+	}
+
+	return me
+}
+
+// Intersect restricts merged permissions to the ones allowed by the ceiling.
+func (me Permissions) Intersect(ceiling Permissions) Permissions {
+	for _, kind := range permissionKinds {
+		field := kind.permission(&me)
+		allowed := *kind.permission(&ceiling)
+		if allowed.All {
+			continue
+		}
+
+		if (*field).All {
+			*field = allowed
+			continue
+		}
+
+		var values []string
+		for _, value := range (*field).Values {
+			if slices.ContainsFunc(allowed.Values, func(pattern string) bool { return kind.match(pattern, value) }) {
+				values = append(values, value)
+			}
+		}
+
+		*field = &Permission{Values: values}
+	}
+
+	return me
+}
+
+// Validate checks that the permissions requested by an app don't exceed the
+// merged ceiling, and don't include a denied resource.
+func (me Permissions) Validate(ceiling Permissions, denials Denials) error {
+	for _, kind := range permissionKinds {
+		permission := *kind.permission(&me)
+		if permission == nil {
+			continue
+		}
+
+		allowed := *kind.permission(&ceiling)
+		denied := *kind.denials(&denials)
+
+		if permission.All && !allowed.All {
+			return &PermissionError{Flag: fmt.Sprintf("--allow-%s", kind.name)}
+		}
+
+		for _, value := range permission.Values {
+			flag := fmt.Sprintf("--allow-%s=%s", kind.name, value)
+			if !allowed.All && !slices.ContainsFunc(allowed.Values, func(pattern string) bool { return kind.match(pattern, value) }) {
+				return &PermissionError{Flag: flag}
+			}
+
+			if slices.ContainsFunc(denied, func(pattern string) bool { return kind.match(pattern, value) }) {
+				return &PermissionError{Flag: flag, Denied: true}
+			}
+		}
+	}
+
+	return nil
+}
+
+// maxDeniedRange is the number of addresses of the largest ip range accepted
+// in the network denials. Deno does not support ranges, so they are expanded
+// to the list of their addresses.
+const maxDeniedRange = 256
+
+// Validate checks that the denials can be enforced by deno. The network
+// denials must be hosts or ip addresses, optionally with a port, or small ip
+// ranges, as deno supports neither large ranges nor wildcards.
+func (me Denials) Validate() error {
+	for _, value := range me.Net {
+		if strings.Contains(value, "/") {
+			if _, err := expandRange(value); err != nil {
+				return fmt.Errorf("invalid net denial %s: %w", value, err)
+			}
+
+			continue
+		}
+
+		if value == "" || strings.Contains(value, "*") {
+			return fmt.Errorf("invalid net denial %s: expected a host or an ip address", value)
+		}
+	}
+
+	return nil
+}
+
+// expandRange lists the addresses of an ip range, ipv6 addresses being
+// enclosed in brackets as expected by deno.
+func expandRange(value string) ([]string, error) {
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return nil, fmt.Errorf("expected an ip range, such as 192.168.1.0/24")
+	}
+
+	if size := prefix.Addr().BitLen() - prefix.Bits(); size > 8 {
+		return nil, fmt.Errorf("ip ranges are limited to %d addresses, list the addresses instead", maxDeniedRange)
+	}
+
+	var addrs []string
+	prefix = prefix.Masked()
+	for addr := prefix.Addr(); addr.IsValid() && prefix.Contains(addr); addr = addr.Next() {
+		if addr.Is6() {
+			addrs = append(addrs, fmt.Sprintf("[%s]", addr))
+		} else {
+			addrs = append(addrs, addr.String())
+		}
+	}
+
+	return addrs, nil
+}
+
+// Flags returns the deno --deny-* flags. The env denials are not included,
+// as denied variables are not passed to the app in the first place.
+func (me Denials) Flags() []string {
+	var flags []string
+	for _, kind := range permissionKinds {
+		values := *kind.denials(&me)
+		if kind.name == "env" || len(values) == 0 {
+			continue
+		}
+
+		flags = append(flags, fmt.Sprintf("--deny-%s=%s", kind.name, strings.Join(values, ",")))
+	}
+
+	return flags
+}
+
+// Resolve makes the denied paths absolute, relative paths being resolved from
+// dir, and expands the denied ip ranges. Invalid ranges are dropped, as they
+// are rejected by Validate.
+func (me Denials) Resolve(dir string) Denials {
+	var hosts []string
+	for _, value := range me.Net {
+		if !strings.Contains(value, "/") {
+			hosts = append(hosts, value)
+			continue
+		}
+
+		addrs, _ := expandRange(value)
+		hosts = append(hosts, addrs...)
+	}
+
+	me.Net = hosts
+	me.Read = resolvePaths(me.Read, dir)
+	me.Write = resolvePaths(me.Write, dir)
+	me.Ffi = resolvePaths(me.Ffi, dir)
+	return me
+}
+
+// DeniesEnv reports whether the env variable must be hidden from the app.
+func (me Denials) DeniesEnv(key string) bool {
+	return slices.ContainsFunc(me.Env, func(pattern string) bool { return matchWildcard(pattern, key) })
+}
+
+func resolvePaths(values []string, dir string) []string {
+	var paths []string
+	for _, value := range values {
+		value = utils.ExpandTilde(value)
+		if !filepath.IsAbs(value) {
+			value = filepath.Join(dir, value)
+		}
+
+		paths = append(paths, filepath.Clean(value))
+	}
+
+	return paths
+}
+
+func matchExact(pattern string, value string) bool {
+	return pattern == value
+}
+
+// matchWildcard supports a trailing wildcard, such as AWS_*.
+func matchWildcard(pattern string, value string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(value, prefix)
+	}
+
+	return pattern == value
+}
+
+// matchHost supports subdomain wildcards (*.example.com), and hosts without
+// a port match every port.
+func matchHost(pattern string, value string) bool {
+	if pattern == value {
+		return true
+	}
+
+	host := value
+	if h, _, err := net.SplitHostPort(value); err == nil {
+		host = h
+	}
+
+	if pattern == host || pattern == fmt.Sprintf("[%s]", host) {
+		return true
+	}
+
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix)
+	}
+
+	return false
+}
+
+func matchPath(pattern string, value string) bool {
+	rel, err := filepath.Rel(pattern, value)
+	if err != nil {
+		return false
+	}
+
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
@@ -0,0 +1,307 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPermissionUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Permission
+		wantErr bool
+	}{
+		{input: `true`, want: Permission{All: true}},
+		{input: `false`, want: Permission{}},
+		{input: `["api.github.com"]`, want: Permission{Values: []string{"api.github.com"}}},
+		{input: `"api.github.com"`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var got Permission
+			err := json.Unmarshal([]byte(tt.input), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPermissionsMerge(t *testing.T) {
+	requested := Permissions{
+		Net:  &Permission{Values: []string{"api.github.com"}},
+		Read: &Permission{All: true},
+	}
+
+	defaults := Permissions{
+		Net: &Permission{All: true},
+		Env: &Permission{All: true},
+		Run: &Permission{Values: []string{"ffmpeg"}},
+	}
+
+	got := requested.Merge(defaults)
+	want := Permissions{
+		Net:   &Permission{Values: []string{"api.github.com"}},
+		Env:   &Permission{All: true},
+		Sys:   &Permission{},
+		Read:  &Permission{All: true},
+		Write: &Permission{},
+		Run:   &Permission{Values: []string{"ffmpeg"}},
+		Ffi:   &Permission{},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s, want %s", marshal(t, got), marshal(t, want))
+	}
+
+	if requested.Env != nil {
+		t.Errorf("merge must not modify the receiver")
+	}
+}
+
+func TestPermissionsResolve(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	permissions := Permissions{
+		Net:   &Permission{Values: []string{"example.com"}},
+		Read:  &Permission{Values: []string{"data", "/etc/hosts", "~/shared", "../other/"}},
+		Write: &Permission{All: true},
+		Ffi:   &Permission{Values: []string{"lib/libfoo.so"}},
+	}
+
+	got := permissions.Resolve("/apps/blog")
+	want := Permissions{
+		Net:   &Permission{Values: []string{"example.com"}},
+		Read:  &Permission{Values: []string{"/apps/blog/data", "/etc/hosts", filepath.Join(home, "shared"), "/apps/other"}},
+		Write: &Permission{All: true},
+		Ffi:   &Permission{Values: []string{"/apps/blog/lib/libfoo.so"}},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s, want %s", marshal(t, got), marshal(t, want))
+	}
+}
+
+func TestPermissionsIntersect(t *testing.T) {
+	ceiling := Permissions{
+		Net:  &Permission{Values: []string{"*.github.com", "example.com"}},
+		Env:  &Permission{All: true},
+		Read: &Permission{Values: []string{"/srv/shared"}},
+		Run:  &Permission{},
+	}.Merge(Permissions{})
+
+	permissions := Permissions{
+		Net:  &Permission{Values: []string{"api.github.com", "example.com:8080", "evil.com"}},
+		Env:  &Permission{Values: []string{"HOME"}},
+		Sys:  &Permission{All: true},
+		Read: &Permission{Values: []string{"/srv/shared/assets", "/srv/private"}},
+		Run:  &Permission{All: true},
+	}.Merge(Permissions{})
+
+	got := permissions.Intersect(ceiling)
+	want := Permissions{
+		Net:   &Permission{Values: []string{"api.github.com", "example.com:8080"}},
+		Env:   &Permission{Values: []string{"HOME"}},
+		Sys:   &Permission{},
+		Read:  &Permission{Values: []string{"/srv/shared/assets"}},
+		Write: &Permission{},
+		Run:   &Permission{},
+		Ffi:   &Permission{},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s, want %s", marshal(t, got), marshal(t, want))
+	}
+}
+
+func TestPermissionsValidate(t *testing.T) {
+	ceiling := Permissions{
+		Net:  &Permission{Values: []string{"*.github.com", "example.com"}},
+		Env:  &Permission{All: true},
+		Read: &Permission{Values: []string{"/srv/shared"}},
+	}.Merge(Permissions{})
+
+	denials := Denials{
+		Net:  []string{"secret.github.com", "example.com:22"},
+		Read: []string{"/srv/shared/keys"},
+	}
+
+	tests := []struct {
+		name        string
+		permissions Permissions
+		wantFlag    string
+		wantDenied  bool
+	}{
+		{
+			name: "missing permissions are allowed",
+		},
+		{
+			name: "values within the ceiling",
+			permissions: Permissions{
+				Net:  &Permission{Values: []string{"api.github.com", "example.com:443"}},
+				Env:  &Permission{All: true},
+				Read: &Permission{Values: []string{"/srv/shared", "/srv/shared/assets"}},
+			},
+		},
+		{
+			name:        "all exceeding the ceiling",
+			permissions: Permissions{Net: &Permission{All: true}},
+			wantFlag:    "--allow-net",
+		},
+		{
+			name:        "value exceeding the ceiling",
+			permissions: Permissions{Net: &Permission{Values: []string{"evil.com"}}},
+			wantFlag:    "--allow-net=evil.com",
+		},
+		{
+			name:        "path escaping the ceiling",
+			permissions: Permissions{Read: &Permission{Values: []string{"/srv/shared-secrets"}}},
+			wantFlag:    "--allow-read=/srv/shared-secrets",
+		},
+		{
+			name:        "parent of the ceiling",
+			permissions: Permissions{Read: &Permission{Values: []string{"/srv"}}},
+			wantFlag:    "--allow-read=/srv",
+		},
+		{
+			name:        "denied host",
+			permissions: Permissions{Net: &Permission{Values: []string{"secret.github.com:443"}}},
+			wantFlag:    "--allow-net=secret.github.com:443",
+			wantDenied:  true,
+		},
+		{
+			name:        "denied port",
+			permissions: Permissions{Net: &Permission{Values: []string{"example.com:22"}}},
+			wantFlag:    "--allow-net=example.com:22",
+			wantDenied:  true,
+		},
+		{
+			name:        "denied path",
+			permissions: Permissions{Read: &Permission{Values: []string{"/srv/shared/keys/id_rsa"}}},
+			wantFlag:    "--allow-read=/srv/shared/keys/id_rsa",
+			wantDenied:  true,
+		},
+		{
+			name:        "run is not allowed by default",
+			permissions: Permissions{Run: &Permission{Values: []string{"ffmpeg"}}},
+			wantFlag:    "--allow-run=ffmpeg",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.permissions.Validate(ceiling, denials)
+			if tt.wantFlag == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			var permissionError *PermissionError
+			if !errors.As(err, &permissionError) {
+				t.Fatalf("expected a permission error, got %v", err)
+			}
+
+			if permissionError.Flag != tt.wantFlag || permissionError.Denied != tt.wantDenied {
+				t.Errorf("got %+v, want flag %s (denied: %v)", permissionError, tt.wantFlag, tt.wantDenied)
+			}
+		})
+	}
+}
+
+func TestDenialsValidate(t *testing.T) {
+	tests := []struct {
+		net     []string
+		wantErr bool
+	}{
+		{net: []string{"127.0.0.1", "localhost", "example.com:22", "[::1]", "169.254.169.254"}},
+		{net: []string{"192.168.1.0/24", "10.0.0.8/30", "fd00::/120"}},
+		{net: []string{"10.0.0.0/8"}, wantErr: true},
+		{net: []string{"192.168.0.0/16"}, wantErr: true},
+		{net: []string{"192.168.1.0/23"}, wantErr: true},
+		{net: []string{"fd00::/8"}, wantErr: true},
+		{net: []string{"192.168.1.0/24:80"}, wantErr: true},
+		{net: []string{"localhost/24"}, wantErr: true},
+		{net: []string{"*.internal"}, wantErr: true},
+		{net: []string{""}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		err := Denials{Net: tt.net}.Validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: error = %v, wantErr %v", tt.net, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDenialsFlags(t *testing.T) {
+	denials := Denials{
+		Net:  []string{"127.0.0.1", "localhost"},
+		Env:  []string{"SMALLWEB_*"},
+		Read: []string{"/etc"},
+	}
+
+	got := denials.Flags()
+	want := []string{"--deny-net=127.0.0.1,localhost", "--deny-read=/etc"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDenialsResolveRanges(t *testing.T) {
+	denials := Denials{Net: []string{"localhost", "10.0.0.9/30", "fd00::/127"}}.Resolve("/")
+
+	want := []string{"localhost", "10.0.0.8", "10.0.0.9", "10.0.0.10", "10.0.0.11", "[fd00::]", "[fd00::1]"}
+	if !reflect.DeepEqual(denials.Net, want) {
+		t.Errorf("got %v, want %v", denials.Net, want)
+	}
+
+	if addrs, _ := expandRange("192.168.1.0/24"); len(addrs) != maxDeniedRange || addrs[0] != "192.168.1.0" || addrs[255] != "192.168.1.255" {
+		t.Errorf("got %d addresses, want %d", len(addrs), maxDeniedRange)
+	}
+
+	// an app can't request an address of a denied range
+	err := Permissions{Net: &Permission{Values: []string{"10.0.0.10:5432"}}}.Validate(Permissions{Net: &Permission{All: true}}, denials)
+	var permissionErr *PermissionError
+	if !errors.As(err, &permissionErr) || !permissionErr.Denied {
+		t.Errorf("got error %v, want a denied permission", err)
+	}
+}
+
+func TestDenialsDeniesEnv(t *testing.T) {
+	denials := Denials{Env: []string{"SMALLWEB_*", "AWS_SECRET_ACCESS_KEY"}}
+	for key, want := range map[string]bool{
+		"SMALLWEB_DIR":          true,
+		"AWS_SECRET_ACCESS_KEY": true,
+		"AWS_REGION":            false,
+		"HOME":                  false,
+	} {
+		if got := denials.DeniesEnv(key); got != want {
+			t.Errorf("DeniesEnv(%s) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func marshal(t *testing.T, v any) string {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
@@ -0,0 +1,81 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gobwas/glob"
+)
+
+// Duration is a time.Duration encoded as a string, such as "30s".
+type Duration time.Duration
+
+func (me *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string")
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %s: %w", value, err)
+	}
+
+	*me = Duration(duration)
+	return nil
+}
+
+func (me Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(me).String())
+}
+
+// Timeouts bounds the time spent by the worker serving a request. Zero values
+// inherit the global defaults, and negative values disable the timeout.
+type Timeouts struct {
+	// Header is the time allowed to the app to send the response headers.
+	Header Duration `json:"header,omitempty"`
+	// Request is the time allowed to serve the whole request.
+	Request Duration `json:"request,omitempty"`
+	// Idle is the maximum time between two chunks of the response body.
+	Idle Duration `json:"idle,omitempty"`
+	// StreamingRoutes lists the routes exempted from the request and idle
+	// timeouts, such as server-sent events.
+	StreamingRoutes []string `json:"streamingRoutes,omitempty"`
+}
+
+// Merge fills the unset fields using the defaults. Streaming routes are
+// concatenated.
+func (me Timeouts) Merge(defaults Timeouts) Timeouts {
+	if me.Header == 0 {
+		me.Header = defaults.Header
+	}
+
+	if me.Request == 0 {
+		me.Request = defaults.Request
+	}
+
+	if me.Idle == 0 {
+		me.Idle = defaults.Idle
+	}
+
+	me.StreamingRoutes = append(append([]string{}, defaults.StreamingRoutes...), me.StreamingRoutes...)
+	return me
+}
+
+// IsStreamingRoute reports whether the request and idle timeouts are
+// disabled for the path.
+func (me Timeouts) IsStreamingRoute(path string) bool {
+	for _, route := range me.StreamingRoutes {
+		g, err := glob.Compile(route)
+		if err != nil {
+			continue
+		}
+
+		if g.Match(path) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pomdtr/smallweb/app"
+)
+
+//go:embed embed/forbidden.html.tmpl
+var forbiddenPageBytes []byte
+var forbiddenPageTemplate = template.Must(template.New("forbidden.html").Parse(string(forbiddenPageBytes)))
+
+// authorizedEmails returns the patterns matching the users allowed to access
+// a private app. The email from the global config is always allowed.
+func authorizedEmails(a app.App) []string {
+	var emails []string
+	if email := k.String("email"); email != "" {
+		emails = append(emails, email)
+	}
+
+	emails = append(emails, a.Config.AuthorizedEmails...)
+	if len(a.Config.AuthorizedGroups) == 0 {
+		return emails
+	}
+
+	var groups map[string][]string
+	if err := unmarshalConfig("groups", &groups); err != nil {
+		log.Printf("failed to read groups: %v", err)
+		return emails
+	}
+
+	for _, group := range a.Config.AuthorizedGroups {
+		members, ok := groups[group]
+		if !ok {
+			log.Printf("app %s references an unknown group: %s", a.Name, group)
+			continue
+		}
+
+		emails = append(emails, members...)
+	}
+
+	return emails
+}
+
+// validateGroups checks the emails of the groups from the global config.
+func validateGroups() error {
+	var groups map[string][]string
+	if err := unmarshalConfig("groups", &groups); err != nil {
+		return err
+	}
+
+	for name, members := range groups {
+		for _, member := range members {
+			if err := app.ValidateEmailPattern(member); err != nil {
+				return fmt.Errorf("group %s: %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// isAuthorized reports whether the email matches one of the patterns.
+// Patterns are either emails, or *@<domain> to allow every email of a
+// domain. The * pattern allows anyone, and is only used by the auth domain.
+func isAuthorized(email string, patterns []string) bool {
+	email = strings.ToLower(email)
+	_, emailDomain, _ := strings.Cut(email, "@")
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" {
+			return true
+		}
+
+		// other wildcards are rejected by the config validation, and never
+		// match here
+		if domain, ok := strings.CutPrefix(pattern, "*@"); ok {
+			if emailDomain != "" && emailDomain == domain {
+				return true
+			}
+
+			continue
+		}
+
+		if pattern == email {
+			return true
+		}
+	}
+
+	return false
+}
+
+func serveForbiddenPage(w http.ResponseWriter, r *http.Request, email string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	forbiddenPageTemplate.Execute(w, map[string]interface{}{
+		"Email":     email,
+		"LogoutURL": fmt.Sprintf("/_auth/logout?redirect=%s", url.QueryEscape(r.URL.Path)),
+	})
+}
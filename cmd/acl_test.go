@@ -0,0 +1,47 @@
+package cmd
+
+import "testing"
+
+func TestIsAuthorized(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		patterns []string
+		want     bool
+	}{
+		{name: "exact match", email: "alice@example.com", patterns: []string{"alice@example.com"}, want: true},
+		{name: "other email", email: "bob@example.com", patterns: []string{"alice@example.com"}, want: false},
+		{name: "case folding", email: "Alice@Example.com", patterns: []string{"alice@EXAMPLE.com"}, want: true},
+		{name: "domain wildcard", email: "bob@example.com", patterns: []string{"*@example.com"}, want: true},
+		{name: "domain wildcard case folding", email: "bob@EXAMPLE.COM", patterns: []string{"*@example.com"}, want: true},
+		{name: "look-alike domain", email: "bob@evilexample.com", patterns: []string{"*@example.com"}, want: false},
+		{name: "subdomain", email: "bob@mail.example.com", patterns: []string{"*@example.com"}, want: false},
+		{name: "suffix wildcard", email: "x@evilexample.com", patterns: []string{"*example.com"}, want: false},
+		{name: "nested at sign", email: "bob@evil@example.com", patterns: []string{"*@example.com"}, want: false},
+		{name: "anyone", email: "bob@example.com", patterns: []string{"*"}, want: true},
+		{name: "no patterns", email: "bob@example.com", want: false},
+		{name: "second pattern", email: "bob@example.com", patterns: []string{"alice@example.com", "*@example.com"}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAuthorized(tt.email, tt.patterns); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateGroups(t *testing.T) {
+	defer k.Delete("groups")
+
+	k.Set("groups", map[string]any{"family": []string{"alice@example.com", "*@smith.family"}})
+	if err := validateGroups(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	k.Set("groups", map[string]any{"work": []string{"*example.com"}})
+	if err := validateGroups(); err == nil {
+		t.Error("expected an error for a suffix wildcard")
+	}
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/adrg/xdg"
+	"github.com/pomdtr/smallweb/utils"
+	"github.com/pomdtr/smallweb/watcher"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newCertManager creates an autocert manager issuing certificates on demand,
+// for the hosts mapping to an existing app.
+func newCertManager(appWatcher *watcher.Watcher, domain string) (*autocert.Manager, error) {
+	cacheDir := filepath.Join(xdg.DataHome, "smallweb", "certs")
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create certificate cache directory: %w", err)
+	}
+
+	client := &acme.Client{
+		DirectoryURL: k.String("acme.directory"),
+	}
+
+	// allows to test against a local acme server, such as pebble
+	httpClient, err := utils.NewHTTPClient(k.String("acme.ca"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid acme CA: %w", err)
+	}
+	client.HTTPClient = httpClient
+
+	return &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(cacheDir),
+		Email:  k.String("acme.email"),
+		Client: client,
+		HostPolicy: acmeHostPolicy(appWatcher, domain),
+	}, nil
+}
+
+// acmeHostPolicy only allows certificates for the root domain, the auth
+// domain and the hosts of existing apps, so that anyone pointing a domain to
+// the server can't make it request certificates.
+func acmeHostPolicy(appWatcher *watcher.Watcher, domain string) autocert.HostPolicy {
+	return func(ctx context.Context, host string) error {
+		if host == domain || host == k.String("authDomain") {
+			return nil
+		}
+
+		if hostMatchesApp(appWatcher, domain, host) {
+			return nil
+		}
+
+		return fmt.Errorf("host %s does not match any app", host)
+	}
+}
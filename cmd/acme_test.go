@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pomdtr/smallweb/watcher"
+)
+
+func TestACMEHostPolicy(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stderr)
+
+	k.Set("authDomain", "auth.org")
+	defer k.Delete("authDomain")
+
+	rootDir := t.TempDir()
+	for name, cname := range map[string]string{
+		"blog": "blog.org\nwww.blog.org\n",
+		"api":  "",
+		// domains reserved by smallweb are not indexed
+		"evil": "www.example.com\n",
+	} {
+		dir := filepath.Join(rootDir, name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if cname == "" {
+			continue
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, "CNAME"), []byte(cname), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	appWatcher, err := watcher.NewWatcher(rootDir, "example.com", "auth.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer appWatcher.Close()
+
+	policy := acmeHostPolicy(appWatcher, "example.com")
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "example.com", want: true},
+		{host: "auth.org", want: true},
+		{host: "blog.example.com", want: true},
+		{host: "api.example.com", want: true},
+		{host: "evil.example.com", want: true},
+		{host: "blog.org", want: true},
+		{host: "www.blog.org", want: true},
+		{host: "www.example.com", want: false},
+		{host: "missing.example.com", want: false},
+		{host: "a.blog.example.com", want: false},
+		{host: "blog.example.com.evil.org", want: false},
+		{host: "other.org", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			err := policy(context.Background(), tt.host)
+			if got := err == nil; got != tt.want {
+				t.Errorf("got error %v, want allowed: %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,504 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cli/go-gh/v2/pkg/tableprinter"
+	"github.com/mattn/go-isatty"
+	"github.com/pomdtr/smallweb/database"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+	"golang.org/x/time/rate"
+)
+
+func NewCmdBan(db *sql.DB) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "ban",
+		Short:   "Manage ips banned after failed authentication attempts",
+		GroupID: CoreGroupID,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return migrateDB(db)
+		},
+	}
+
+	cmd.AddCommand(NewCmdBanList(db))
+	cmd.AddCommand(NewCmdBanRemove(db))
+	return cmd
+}
+
+func NewCmdBanList(db *sql.DB) *cobra.Command {
+	var flags struct {
+		json bool
+	}
+
+	cmd := &cobra.Command{
+		Use:     "list",
+		Short:   "List active bans",
+		Aliases: []string{"ls"},
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			bans, err := activeBans(db)
+			if err != nil {
+				return err
+			}
+
+			if flags.json {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetEscapeHTML(false)
+
+				if isatty.IsTerminal(os.Stdout.Fd()) {
+					encoder.SetIndent("", "  ")
+				}
+
+				if err := encoder.Encode(bans); err != nil {
+					return fmt.Errorf("failed to encode bans: %w", err)
+				}
+
+				return nil
+			}
+
+			if len(bans) == 0 {
+				fmt.Println("No bans found")
+				return nil
+			}
+
+			var printer tableprinter.TablePrinter
+			if isatty.IsTerminal(os.Stdout.Fd()) {
+				width, _, err := term.GetSize(int(os.Stdout.Fd()))
+				if err != nil {
+					return fmt.Errorf("failed to get terminal size: %w", err)
+				}
+
+				printer = tableprinter.New(os.Stdout, true, width)
+			} else {
+				printer = tableprinter.New(os.Stdout, false, 0)
+			}
+
+			printer.AddHeader([]string{"Key", "Reason", "Creation Time", "Expiration Time"})
+			for _, ban := range bans {
+				printer.AddField(ban.Key)
+				printer.AddField(ban.Reason)
+				printer.AddField(ban.CreatedAt.Format("2006-01-02 15:04:05"))
+				printer.AddField(ban.ExpiresAt.Format("2006-01-02 15:04:05"))
+				printer.EndRow()
+			}
+
+			return printer.Render()
+		},
+	}
+
+	cmd.Flags().BoolVarP(&flags.json, "json", "j", false, "output as JSON")
+	return cmd
+}
+
+func NewCmdBanRemove(db *sql.DB) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "remove <key>...",
+		Short:   "Lift bans",
+		Aliases: []string{"rm", "delete"},
+		Args:    cobra.MinimumNArgs(1),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			bans, err := activeBans(db)
+			if err != nil {
+				return nil, cobra.ShellCompDirectiveError
+			}
+
+			var completions []string
+			for _, ban := range bans {
+				completions = append(completions, fmt.Sprintf("%s\t%s", ban.Key, ban.Reason))
+			}
+
+			return completions, cobra.ShellCompDirectiveNoFileComp
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			for _, arg := range args {
+				if err := database.DeleteBan(db, arg); err != nil {
+					if errors.Is(err, sql.ErrNoRows) {
+						return fmt.Errorf("ban %s not found", arg)
+					}
+
+					return fmt.Errorf("failed to delete ban: %w", err)
+				}
+
+				cmd.Printf("Ban %s removed\n", arg)
+			}
+
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+func activeBans(db *sql.DB) ([]database.Ban, error) {
+	bans, err := database.ListBans(db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bans: %w", err)
+	}
+
+	var active []database.Ban
+	for _, ban := range bans {
+		if time.Now().Before(ban.ExpiresAt) {
+			active = append(active, ban)
+		}
+	}
+
+	return active, nil
+}
+
+// authLimiter bans the ips with too many failed authentication
+// attempts. Bans are persisted, so that they survive restarts and can be
+// lifted using the cli.
+type authLimiter struct {
+	db             *sql.DB
+	maxFailures    int
+	window         time.Duration
+	banDuration    time.Duration
+	maxBanDuration time.Duration
+
+	// the checks of a token id failing too often are spaced by
+	// tokenInterval, requests waiting longer than maxTokenDelay are rejected
+	tokenInterval time.Duration
+	maxTokenDelay time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*authLimiterEntry
+	tokens  map[string]*tokenThrottle
+}
+
+// tokenThrottle tracks the failures of a token id. Token ids are not secret,
+// so they are throttled instead of banned: a ban would allow anyone to lock
+// the owner of the token out.
+type tokenThrottle struct {
+	failures []time.Time
+	limiter  *rate.Limiter
+}
+
+type authLimiterEntry struct {
+	failures    []time.Time
+	lastFailure time.Time
+	// number of bans, used to compute the duration of the next one
+	bans        int
+	bannedUntil time.Time
+}
+
+func newAuthLimiter(db *sql.DB) (*authLimiter, error) {
+	limiter := &authLimiter{
+		db:             db,
+		maxFailures:    k.Int("authLimits.maxFailures"),
+		window:         k.Duration("authLimits.window"),
+		banDuration:    k.Duration("authLimits.banDuration"),
+		maxBanDuration: k.Duration("authLimits.maxBanDuration"),
+		tokenInterval:  time.Second,
+		maxTokenDelay:  5 * time.Second,
+		entries:        make(map[string]*authLimiterEntry),
+		tokens:         make(map[string]*tokenThrottle),
+	}
+
+	bans, err := activeBans(db)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ban := range bans {
+		limiter.entries[ban.Key] = &authLimiterEntry{
+			bans:        1,
+			lastFailure: ban.CreatedAt,
+			bannedUntil: ban.ExpiresAt,
+		}
+	}
+
+	return limiter, nil
+}
+
+// Check returns how long the key is banned for, if it is banned.
+func (me *authLimiter) Check(key string) (time.Duration, bool) {
+	if me.maxFailures <= 0 {
+		return 0, false
+	}
+
+	me.mu.Lock()
+	entry, ok := me.entries[key]
+	var bannedUntil time.Time
+	if ok {
+		bannedUntil = entry.bannedUntil
+	}
+	me.mu.Unlock()
+
+	if !time.Now().Before(bannedUntil) {
+		return 0, false
+	}
+
+	// the ban may have been lifted using the cli
+	if _, err := database.GetBan(me.db, key); errors.Is(err, sql.ErrNoRows) {
+		me.mu.Lock()
+		delete(me.entries, key)
+		me.mu.Unlock()
+		return 0, false
+	}
+
+	return time.Until(bannedUntil), true
+}
+
+// Fail records a failed attempt, and bans the key if it reached the maximum
+// number of failures. Each ban lasts twice as long as the previous one.
+func (me *authLimiter) Fail(key string) {
+	if me.maxFailures <= 0 {
+		return
+	}
+
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := me.entries[key]
+	if !ok {
+		if len(me.entries) > 4096 {
+			me.prune(now)
+		}
+
+		entry = &authLimiterEntry{}
+		me.entries[key] = entry
+	}
+
+	if now.Sub(entry.lastFailure) > me.maxBanDuration {
+		entry.bans = 0
+	}
+
+	entry.failures = append(recentFailures(entry.failures, now, me.window), now)
+	entry.lastFailure = now
+
+	if len(entry.failures) < me.maxFailures {
+		return
+	}
+
+	duration := me.banDuration << entry.bans
+	if duration <= 0 || duration > me.maxBanDuration {
+		duration = me.maxBanDuration
+	}
+
+	entry.bans++
+	entry.failures = nil
+	entry.bannedUntil = now.Add(duration)
+
+	ban := database.Ban{
+		Key:       key,
+		Reason:    fmt.Sprintf("%d failed authentication attempts", me.maxFailures),
+		CreatedAt: now,
+		ExpiresAt: entry.bannedUntil,
+	}
+
+	log.Printf("banning %s for %s after %d failed authentication attempts", key, duration, me.maxFailures)
+	if err := database.UpsertBan(me.db, ban); err != nil {
+		log.Printf("failed to persist ban: %v", err)
+	}
+}
+
+// Throttle waits until the token id can be checked again, if it failed to
+// authenticate too many times. It returns false if the wait would exceed the
+// maximum delay, along with how long to wait before retrying.
+func (me *authLimiter) Throttle(ctx context.Context, tokenID string) (time.Duration, bool) {
+	if me.maxFailures <= 0 {
+		return 0, true
+	}
+
+	now := time.Now()
+	me.mu.Lock()
+	throttle, ok := me.tokens[tokenID]
+	if !ok {
+		me.mu.Unlock()
+		return 0, true
+	}
+
+	throttle.failures = recentFailures(throttle.failures, now, me.window)
+	if len(throttle.failures) < me.maxFailures {
+		me.mu.Unlock()
+		return 0, true
+	}
+
+	reservation := throttle.limiter.ReserveN(now, 1)
+	me.mu.Unlock()
+
+	delay := reservation.DelayFrom(now)
+	if delay > me.maxTokenDelay {
+		reservation.CancelAt(now)
+		return delay, false
+	}
+
+	if err := sleep(ctx, delay); err != nil {
+		return delay, false
+	}
+
+	return 0, true
+}
+
+// FailToken records a failed attempt to authenticate using the token id.
+func (me *authLimiter) FailToken(tokenID string) {
+	if me.maxFailures <= 0 {
+		return
+	}
+
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	now := time.Now()
+	throttle, ok := me.tokens[tokenID]
+	if !ok {
+		if len(me.tokens) > 4096 {
+			me.pruneTokens(now)
+		}
+
+		throttle = &tokenThrottle{limiter: rate.NewLimiter(rate.Every(me.tokenInterval), 1)}
+		me.tokens[tokenID] = throttle
+	}
+
+	throttle.failures = append(recentFailures(throttle.failures, now, me.window), now)
+	if len(throttle.failures) == me.maxFailures {
+		log.Printf("throttling token %s after %d failed authentication attempts", tokenID, me.maxFailures)
+	}
+}
+
+func (me *authLimiter) pruneTokens(now time.Time) {
+	for tokenID, throttle := range me.tokens {
+		if len(recentFailures(throttle.failures, now, me.window)) > 0 {
+			continue
+		}
+
+		delete(me.tokens, tokenID)
+	}
+}
+
+func recentFailures(failures []time.Time, now time.Time, window time.Duration) []time.Time {
+	var recent []time.Time
+	for _, failure := range failures {
+		if now.Sub(failure) < window {
+			recent = append(recent, failure)
+		}
+	}
+
+	return recent
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (me *authLimiter) prune(now time.Time) {
+	for key, entry := range me.entries {
+		if now.Before(entry.bannedUntil) || now.Sub(entry.lastFailure) < me.maxBanDuration {
+			continue
+		}
+
+		delete(me.entries, key)
+	}
+}
+
+// clientIP returns the ip of the client. Requests coming from one of the
+// trusted proxies of the global config are attributed to the address found
+// in their X-Forwarded-For header.
+func clientIP(r *http.Request) string {
+	trusted, _ := trustedProxies()
+	return forwardedIP(r, trusted)
+}
+
+// trustedProxies parses the trustedProxies field of the global config, which
+// lists ip addresses and ranges.
+func trustedProxies() ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range k.Strings("trustedProxies") {
+		if prefix, err := netip.ParsePrefix(value); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return prefixes, fmt.Errorf("invalid trusted proxy: %s", value)
+		}
+
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+
+	return prefixes, nil
+}
+
+// forwardedIP walks the X-Forwarded-For header from right to left, starting
+// from the remote address, and returns the first address which is not a
+// trusted proxy. Addresses left of it are ignored, as clients can forge them.
+func forwardedIP(r *http.Request, trusted []netip.Prefix) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+
+	if !isTrustedProxy(ip, trusted) {
+		return ip
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		value := strings.TrimSpace(forwarded[i])
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			// an invalid entry can't be trusted, the last proxy is used instead
+			return ip
+		}
+
+		ip = addr.Unmap().String()
+		if !isTrustedProxy(ip, trusted) {
+			return ip
+		}
+	}
+
+	return ip
+}
+
+func isTrustedProxy(ip string, trusted []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+}
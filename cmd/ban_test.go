@@ -0,0 +1,367 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/pomdtr/smallweb/app"
+	"github.com/pomdtr/smallweb/database"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
+)
+
+func TestForwardedIP(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("127.0.0.1/32"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{
+			name:       "untrusted remote address",
+			remoteAddr: "203.0.113.7:1234",
+			forwarded:  []string{"198.51.100.1"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "127.0.0.1:1234",
+			forwarded:  []string{"198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "chain of trusted proxies",
+			remoteAddr: "127.0.0.1:1234",
+			forwarded:  []string{"198.51.100.1, 10.0.0.2", "10.0.0.3"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "forged entries are ignored",
+			remoteAddr: "127.0.0.1:1234",
+			forwarded:  []string{"1.1.1.1, 198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "invalid entry",
+			remoteAddr: "127.0.0.1:1234",
+			forwarded:  []string{"198.51.100.1, garbage"},
+			want:       "127.0.0.1",
+		},
+		{
+			name:       "trusted proxy without header",
+			remoteAddr: "127.0.0.1:1234",
+			want:       "127.0.0.1",
+		},
+		{
+			name:       "ipv4 mapped ipv6",
+			remoteAddr: "[::ffff:127.0.0.1]:1234",
+			forwarded:  []string{"::ffff:198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+
+			if got := forwardedIP(r, trusted); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	k.Set("trustedProxies", []string{"127.0.0.1", "10.0.0.0/8", "::1"})
+	defer k.Delete("trustedProxies")
+
+	prefixes, err := trustedProxies()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(prefixes) != 3 || prefixes[0].String() != "127.0.0.1/32" || prefixes[1].String() != "10.0.0.0/8" || prefixes[2].String() != "::1/128" {
+		t.Errorf("got %v", prefixes)
+	}
+
+	k.Set("trustedProxies", []string{"proxy.internal"})
+	if _, err := trustedProxies(); err == nil {
+		t.Error("expected an error for an invalid proxy")
+	}
+}
+
+func newTestAuthLimiter(db *sql.DB) *authLimiter {
+	return &authLimiter{
+		db:             db,
+		maxFailures:    3,
+		window:         time.Minute,
+		banDuration:    time.Minute,
+		maxBanDuration: time.Hour,
+		tokenInterval:  100 * time.Millisecond,
+		maxTokenDelay:  time.Second,
+		entries:        make(map[string]*authLimiterEntry),
+		tokens:         make(map[string]*tokenThrottle),
+	}
+}
+
+func TestAuthLimiter(t *testing.T) {
+	db := openTestDB(t)
+	limiter := newTestAuthLimiter(db)
+
+	for i := 0; i < 2; i++ {
+		limiter.Fail("ip:1.2.3.4")
+	}
+
+	if _, banned := limiter.Check("ip:1.2.3.4"); banned {
+		t.Fatal("banned before reaching the maximum number of failures")
+	}
+
+	limiter.Fail("ip:1.2.3.4")
+	retryAfter, banned := limiter.Check("ip:1.2.3.4")
+	if !banned {
+		t.Fatal("expected a ban after the maximum number of failures")
+	}
+
+	if retryAfter <= 0 || retryAfter > time.Minute {
+		t.Errorf("retry after %s, want at most %s", retryAfter, time.Minute)
+	}
+
+	if _, banned := limiter.Check("ip:5.6.7.8"); banned {
+		t.Error("other ips must not be banned")
+	}
+
+	if _, err := database.GetBan(db, "ip:1.2.3.4"); err != nil {
+		t.Errorf("ban was not persisted: %v", err)
+	}
+
+	t.Run("bans double in duration", func(t *testing.T) {
+		entry := limiter.entries["ip:1.2.3.4"]
+		entry.bannedUntil = time.Now().Add(-time.Second)
+		for i := 0; i < 3; i++ {
+			limiter.Fail("ip:1.2.3.4")
+		}
+
+		retryAfter, banned := limiter.Check("ip:1.2.3.4")
+		if !banned || retryAfter <= time.Minute || retryAfter > 2*time.Minute {
+			t.Errorf("got a ban of %s (banned: %v), want 2m", retryAfter, banned)
+		}
+	})
+
+	t.Run("failures outside of the window are forgotten", func(t *testing.T) {
+		limiter.Fail("ip:9.9.9.9")
+		limiter.Fail("ip:9.9.9.9")
+		entry := limiter.entries["ip:9.9.9.9"]
+		for i := range entry.failures {
+			entry.failures[i] = entry.failures[i].Add(-2 * time.Minute)
+		}
+
+		limiter.Fail("ip:9.9.9.9")
+		if _, banned := limiter.Check("ip:9.9.9.9"); banned {
+			t.Error("expected old failures to be ignored")
+		}
+	})
+
+	t.Run("bans lifted using the cli", func(t *testing.T) {
+		if err := database.DeleteBan(db, "ip:1.2.3.4"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, banned := limiter.Check("ip:1.2.3.4"); banned {
+			t.Error("expected the ban to be lifted")
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		limiter := newTestAuthLimiter(db)
+		limiter.maxFailures = 0
+		for i := 0; i < 10; i++ {
+			limiter.Fail("ip:1.2.3.4")
+		}
+
+		if _, banned := limiter.Check("ip:1.2.3.4"); banned {
+			t.Error("bans must be disabled")
+		}
+	})
+}
+
+func TestAuthLimiterThrottlesTokens(t *testing.T) {
+	limiter := newTestAuthLimiter(openTestDB(t))
+
+	for i := 0; i < 2; i++ {
+		limiter.FailToken("abc")
+	}
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, ok := limiter.Throttle(context.Background(), "abc"); !ok {
+			t.Fatal("token throttled before reaching the maximum number of failures")
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("checks were delayed by %s", elapsed)
+	}
+
+	limiter.FailToken("abc")
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		if _, ok := limiter.Throttle(context.Background(), "abc"); !ok {
+			t.Fatal("throttled checks must be delayed, not rejected")
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 2*limiter.tokenInterval {
+		t.Errorf("3 checks took %s, want at least %s", elapsed, 2*limiter.tokenInterval)
+	}
+
+	if _, ok := limiter.Throttle(context.Background(), "other"); !ok {
+		t.Error("other tokens must not be throttled")
+	}
+
+	if _, err := database.GetBan(openTestDB(t), "token:abc"); !errors.Is(err, sql.ErrNoRows) {
+		t.Error("token ids must never be banned")
+	}
+
+	t.Run("rejected when the delay is too long", func(t *testing.T) {
+		limiter.maxTokenDelay = limiter.tokenInterval / 2
+		limiter.Throttle(context.Background(), "abc")
+		retryAfter, ok := limiter.Throttle(context.Background(), "abc")
+		if ok || retryAfter <= 0 {
+			t.Errorf("got ok %v and retry after %s, want a rejection", ok, retryAfter)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		limiter.maxTokenDelay = time.Minute
+		limiter.tokenInterval = time.Minute
+		limiter.tokens["slow"] = &tokenThrottle{limiter: rate.NewLimiter(rate.Every(time.Minute), 1)}
+		for i := 0; i < 3; i++ {
+			limiter.FailToken("slow")
+		}
+
+		limiter.Throttle(context.Background(), "slow")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, ok := limiter.Throttle(ctx, "slow"); ok {
+			t.Error("expected the check to be cancelled")
+		}
+	})
+}
+
+func TestNewAuthLimiterLoadsBans(t *testing.T) {
+	db := openTestDB(t)
+	k.Set("authLimits.maxFailures", 5)
+	defer k.Delete("authLimits")
+
+	if err := database.UpsertBan(db, database.Ban{Key: "ip:1.2.3.4", Reason: "test", CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := database.UpsertBan(db, database.Ban{Key: "ip:5.6.7.8", Reason: "test", CreatedAt: time.Now().Add(-2 * time.Hour), ExpiresAt: time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	limiter, err := newAuthLimiter(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, banned := limiter.Check("ip:1.2.3.4"); !banned {
+		t.Error("active bans must survive restarts")
+	}
+
+	if _, banned := limiter.Check("ip:5.6.7.8"); banned {
+		t.Error("expired bans must be ignored")
+	}
+}
+
+func TestAuthMiddlewareTokenBans(t *testing.T) {
+	db := openTestDB(t)
+	k.Set("trustedProxies", []string{"127.0.0.1"})
+	defer k.Delete("trustedProxies")
+
+	value, public, secret, err := generateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := database.InsertToken(db, database.Token{ID: public, Hash: hash, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, wrongSecret, err := generateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	middleware := &AuthMiddleware{db: db, limiter: newTestAuthLimiter(db)}
+	a := app.App{Name: "example", Dir: t.TempDir(), Config: app.AppConfig{Private: true}}
+	handler := middleware.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), a)
+
+	request := func(token string, ip string) int {
+		r := httptest.NewRequest(http.MethodGet, "https://example.localhost/", nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", ip)
+		r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// an attacker knowing the token id fails to guess its secret
+	forged := fmt.Sprintf("%s_%s_%s", tokenPrefix, public, wrongSecret)
+	for i := 0; i < 3; i++ {
+		if code := request(forged, "203.0.113.7"); code != http.StatusUnauthorized {
+			t.Fatalf("got status %d, want %d", code, http.StatusUnauthorized)
+		}
+	}
+
+	if code := request(forged, "203.0.113.7"); code != http.StatusTooManyRequests {
+		t.Errorf("attacker: got status %d, want %d", code, http.StatusTooManyRequests)
+	}
+
+	if code := request(value, "198.51.100.1"); code != http.StatusNoContent {
+		t.Errorf("owner: got status %d, want %d", code, http.StatusNoContent)
+	}
+
+	// the same attack distributed across ips is slowed down by the token
+	// throttle, without banning any of them
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if code := request(forged, fmt.Sprintf("192.0.2.%d", i+1)); code != http.StatusUnauthorized {
+			t.Fatalf("distributed attacker: got status %d, want %d", code, http.StatusUnauthorized)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 2*middleware.limiter.tokenInterval {
+		t.Errorf("3 attempts took %s, want them to be throttled", elapsed)
+	}
+
+	var tokenBan database.Ban
+	if tokenBan, err = database.GetBan(db, fmt.Sprintf("token:%s", public)); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("token %s must not be banned, got %+v", public, tokenBan)
+	}
+}
@@ -0,0 +1,334 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"maps"
+	"math/big"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/adrg/xdg"
+	"github.com/pomdtr/smallweb/app"
+	"github.com/pomdtr/smallweb/utils"
+	"github.com/pomdtr/smallweb/watcher"
+	"github.com/spf13/cobra"
+)
+
+var (
+	localCADir      = filepath.Join(xdg.DataHome, "smallweb", "ca")
+	localCACertPath = filepath.Join(localCADir, "ca.pem")
+	localCAKeyPath  = filepath.Join(localCADir, "ca-key.pem")
+	localCertPath   = filepath.Join(localCADir, "cert.pem")
+	localKeyPath    = filepath.Join(localCADir, "key.pem")
+)
+
+const (
+	localCertValidity = 90 * 24 * time.Hour
+	localCertRenewal  = 30 * 24 * time.Hour
+)
+
+func NewCmdCert() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "cert",
+		Short:   "Manage the local certificate authority",
+		GroupID: CoreGroupID,
+	}
+
+	cmd.AddCommand(NewCmdCertInit())
+	cmd.AddCommand(NewCmdCertRenew())
+	cmd.AddCommand(NewCmdCertTrust())
+	return cmd
+}
+
+func NewCmdCertInit() *cobra.Command {
+	var flags struct {
+		force bool
+	}
+
+	cmd := &cobra.Command{
+		Use:   "init",
+		Short: "Generate a local root CA, and a certificate for the configured domain",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if utils.FileExists(localCACertPath) && !flags.force {
+				return fmt.Errorf("local CA already exists, use --force to overwrite it")
+			}
+
+			if err := createLocalCA(); err != nil {
+				return fmt.Errorf("failed to create local CA: %w", err)
+			}
+
+			hosts, err := localCertHosts()
+			if err != nil {
+				return err
+			}
+
+			if err := issueLocalCert(hosts); err != nil {
+				return fmt.Errorf("failed to issue certificate: %w", err)
+			}
+
+			cmd.Printf("Local CA created at %s\n\n", localCACertPath)
+			cmd.Print(trustInstructions())
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVarP(&flags.force, "force", "f", false, "overwrite the existing CA")
+	return cmd
+}
+
+func NewCmdCertRenew() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "renew",
+		Short: "Issue a new certificate for the configured domain",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			hosts, err := localCertHosts()
+			if err != nil {
+				return err
+			}
+
+			if err := issueLocalCert(hosts); err != nil {
+				return fmt.Errorf("failed to issue certificate: %w", err)
+			}
+
+			cmd.Printf("Certificate issued at %s\n", localCertPath)
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+func NewCmdCertTrust() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "trust",
+		Short: "Print instructions to add the local CA to your trust store",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !utils.FileExists(localCACertPath) {
+				return fmt.Errorf("local CA not found, run smallweb cert init first")
+			}
+
+			cmd.Print(trustInstructions())
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+func trustInstructions() string {
+	var instructions string
+	switch runtime.GOOS {
+	case "darwin":
+		instructions = fmt.Sprintf("To trust the local CA, run:\n\n  sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain %s\n", localCACertPath)
+	default:
+		instructions = fmt.Sprintf(`To trust the local CA, run:
+
+  # debian, ubuntu
+  sudo cp %s /usr/local/share/ca-certificates/smallweb.crt && sudo update-ca-certificates
+
+  # fedora, arch
+  sudo trust anchor --store %s
+`, localCACertPath, localCACertPath)
+	}
+
+	return instructions + "\nFirefox uses its own trust store, you'll need to import the CA from its settings.\n"
+}
+
+// localCertHosts returns the hosts covered by the local certificate. Apps are
+// listed explicitly, as browsers reject wildcards such as *.localhost.
+func localCertHosts() ([]string, error) {
+	rootDir := utils.ExpandTilde(k.String("dir"))
+	names, err := app.ListApps(rootDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list apps: %w", err)
+	}
+
+	var apps []app.App
+	for _, name := range names {
+		a, err := app.LoadApp(filepath.Join(rootDir, name), k.String("domain"))
+		if err != nil {
+			continue
+		}
+
+		apps = append(apps, a)
+	}
+
+	domains := watcher.IndexDomains(apps, k.String("domain"), k.String("authDomain"))
+	return appHosts(k.String("domain"), apps, slices.Sorted(maps.Keys(domains))), nil
+}
+
+// appHosts returns the hosts served by smallweb, given the custom domains
+// accepted for the apps.
+func appHosts(domain string, apps []app.App, domains []string) []string {
+	hosts := []string{domain, fmt.Sprintf("*.%s", domain)}
+	if authDomain := k.String("authDomain"); authDomain != "" {
+		hosts = append(hosts, authDomain)
+	}
+
+	for _, a := range apps {
+		hosts = append(hosts, fmt.Sprintf("%s.%s", a.Name, domain))
+	}
+	hosts = append(hosts, domains...)
+
+	return hosts
+}
+
+func createLocalCA() error {
+	if err := os.MkdirAll(localCADir, 0700); err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: "smallweb local CA", Organization: []string{"smallweb"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	return writeCertAndKey(localCACertPath, localCAKeyPath, der, key)
+}
+
+func loadLocalCA() (*x509.Certificate, crypto.Signer, error) {
+	pair, err := tls.LoadX509KeyPair(localCACertPath, localCAKeyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load local CA: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse local CA: %w", err)
+	}
+
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid local CA key")
+	}
+
+	return cert, signer, nil
+}
+
+func issueLocalCert(hosts []string) error {
+	caCert, caKey, err := loadLocalCA()
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: hosts[0], Organization: []string{"smallweb"}},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(localCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	return writeCertAndKey(localCertPath, localKeyPath, der, key)
+}
+
+func writeCertAndKey(certPath string, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0600); err != nil {
+		return err
+	}
+
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// localCertificates serves the certificate signed by the local CA, and
+// issues a new one when it is about to expire or does not cover a host.
+type localCertificates struct {
+	hosts func() []string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+}
+
+func (me *localCertificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if me.cert == nil {
+		cert, err := tls.LoadX509KeyPair(localCertPath, localKeyPath)
+		if err == nil {
+			me.cert = &cert
+		}
+	}
+
+	if me.cert != nil && time.Until(me.cert.Leaf.NotAfter) > localCertRenewal {
+		// wildcards are not enough, hosts must be listed explicitly
+		if hello.ServerName == "" || slices.Contains(me.cert.Leaf.DNSNames, hello.ServerName) {
+			return me.cert, nil
+		}
+	}
+
+	hosts := me.hosts()
+	if hello.ServerName != "" && !slices.Contains(hosts, hello.ServerName) {
+		return nil, fmt.Errorf("host %s does not match any app", hello.ServerName)
+	}
+
+	if err := issueLocalCert(hosts); err != nil {
+		return nil, fmt.Errorf("failed to issue certificate: %w", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(localCertPath, localKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	me.cert = &cert
+	return me.cert, nil
+}
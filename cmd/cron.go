@@ -1,36 +1,49 @@
 package cmd
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cli/go-gh/v2/pkg/tableprinter"
 	"github.com/mattn/go-isatty"
 	"github.com/pomdtr/smallweb/app"
+	"github.com/pomdtr/smallweb/database"
 	"github.com/pomdtr/smallweb/utils"
-	"github.com/pomdtr/smallweb/worker"
 	"github.com/spf13/cobra"
 	"golang.org/x/term"
 )
 
-func NewCmdCron() *cobra.Command {
+func NewCmdCron(db *sql.DB) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:     "cron",
 		Short:   "Manage cron jobs",
 		GroupID: CoreGroupID,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return migrateDB(db)
+		},
 	}
 
-	cmd.AddCommand(NewCmdCronList())
-	cmd.AddCommand(NewCmdCronTrigger())
+	cmd.AddCommand(NewCmdCronList(db))
+	cmd.AddCommand(NewCmdCronTrigger(db))
+	cmd.AddCommand(NewCmdCronHistory(db))
+	cmd.AddCommand(NewCmdCronLogs(db))
 	return cmd
 }
 
 type CronItem struct {
-	ID  string `json:"id"`
-	App string `json:"app"`
+	ID       string            `json:"id"`
+	App      string            `json:"app"`
+	LastRun  *database.CronRun `json:"lastRun,omitempty"`
+	NextRuns []time.Time       `json:"nextRuns,omitempty"`
 	app.CronJob
 }
 
@@ -58,10 +71,11 @@ func completeApp(rootDir string) func(cmd *cobra.Command, args []string, toCompl
 	}
 }
 
-func NewCmdCronList() *cobra.Command {
+func NewCmdCronList(db *sql.DB) *cobra.Command {
 	var flags struct {
 		json bool
 		app  string
+		next int
 	}
 
 	cmd := &cobra.Command{
@@ -96,6 +110,32 @@ func NewCmdCronList() *cobra.Command {
 				crons = append(crons, items...)
 			}
 
+			for i, item := range crons {
+				runs, err := database.ListCronRuns(db, item.ID, 1)
+				if err != nil {
+					return fmt.Errorf("failed to list cron runs: %w", err)
+				}
+
+				if len(runs) > 0 {
+					crons[i].LastRun = &runs[0]
+				}
+
+				// invalid schedules are reported by the scheduler
+				schedule, err := parseCronSchedule(item.CronJob)
+				if err != nil {
+					continue
+				}
+
+				next := time.Now().In(cronLocation(schedule))
+				for j := 0; j < flags.next; j++ {
+					next = schedule.Next(next)
+					if next.IsZero() {
+						break
+					}
+					crons[i].NextRuns = append(crons[i].NextRuns, next)
+				}
+			}
+
 			if flags.json {
 				encoder := json.NewEncoder(os.Stdout)
 				encoder.SetEscapeHTML(false)
@@ -126,17 +166,36 @@ func NewCmdCronList() *cobra.Command {
 				printer = tableprinter.New(os.Stdout, false, 0)
 			}
 
-			printer.AddHeader([]string{"ID", "Schedule", "Args", "Description"})
+			printer.AddHeader([]string{"ID", "Schedule", "Args", "Description", "Last Run", "Next Runs"})
 			for _, item := range crons {
 				printer.AddField(item.ID)
 				printer.AddField(item.Schedule)
 
-				args, err := json.Marshal(item.Args)
-				if err != nil {
-					return fmt.Errorf("failed to marshal args: %w", err)
+				if item.Path != "" {
+					method := item.Method
+					if method == "" {
+						method = http.MethodGet
+					}
+					printer.AddField(fmt.Sprintf("%s %s", strings.ToUpper(method), item.Path))
+				} else {
+					args, err := json.Marshal(item.Args)
+					if err != nil {
+						return fmt.Errorf("failed to marshal args: %w", err)
+					}
+					printer.AddField(string(args))
 				}
-				printer.AddField(string(args))
 				printer.AddField(item.Description)
+				if item.LastRun != nil {
+					printer.AddField(fmt.Sprintf("%s (%s)", item.LastRun.StartedAt.Format("2006-01-02 15:04:05"), item.LastRun.Status))
+				} else {
+					printer.AddField("")
+				}
+
+				var nextRuns []string
+				for _, next := range item.NextRuns {
+					nextRuns = append(nextRuns, next.Format("2006-01-02 15:04 MST"))
+				}
+				printer.AddField(strings.Join(nextRuns, ", "))
 
 				printer.EndRow()
 			}
@@ -151,84 +210,259 @@ func NewCmdCronList() *cobra.Command {
 
 	cmd.Flags().StringVar(&flags.app, "app", "", "filter by app")
 	cmd.Flags().BoolVar(&flags.json, "json", false, "output as json")
+	cmd.Flags().IntVar(&flags.next, "next", 1, "number of upcoming runs to show")
 	cmd.RegisterFlagCompletionFunc("app", completeApp(utils.ExpandTilde(k.String("dir"))))
 
 	return cmd
 }
 
-func NewCmdCronTrigger() *cobra.Command {
+func completeCronJob(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	rootDir := utils.ExpandTilde(k.String("dir"))
+
+	var completions []string
+	apps, err := app.ListApps(rootDir)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+
+	for _, name := range apps {
+		app, err := app.LoadApp(filepath.Join(rootDir, name), k.String("domain"))
+		if err != nil {
+			continue
+		}
+
+		jobs, err := ListCronItems(app)
+		if err != nil {
+			continue
+		}
+
+		for _, job := range jobs {
+			completions = append(completions, fmt.Sprintf("%s\t%s", job.ID, job.Description))
+		}
+	}
+
+	return completions, cobra.ShellCompDirectiveDefault
+}
+
+func NewCmdCronTrigger(db *sql.DB) *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "trigger <id>",
-		Short: "Trigger a cron job",
-		Args:  cobra.ExactArgs(1),
-		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		Use:               "trigger <id>",
+		Short:             "Trigger a cron job",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeCronJob,
+		RunE: func(cmd *cobra.Command, args []string) error {
 			rootDir := utils.ExpandTilde(k.String("dir"))
+			parts := strings.Split(args[0], ":")
+			if len(parts) != 2 {
+				return fmt.Errorf("invalid job name")
+			}
 
-			var completions []string
-			apps, err := app.ListApps(rootDir)
+			appname, jobName := parts[0], parts[1]
+			a, err := app.LoadApp(filepath.Join(rootDir, appname), k.String("domain"))
 			if err != nil {
-				return nil, cobra.ShellCompDirectiveDefault
+				return fmt.Errorf("failed to get app: %w", err)
 			}
 
-			for _, name := range apps {
-				app, err := app.LoadApp(filepath.Join(rootDir, name), k.String("domain"))
-				if err != nil {
+			for _, job := range a.Config.Crons {
+				if job.Name != jobName {
 					continue
 				}
 
-				jobs, err := ListCronItems(app)
+				logStore, err := newLogStore()
 				if err != nil {
-					continue
+					return err
+				}
+				defer logStore.Close()
+
+				ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt)
+				defer cancel()
+
+				var handler http.Handler
+				if job.Path != "" {
+					// outside of smallweb up, the request is sent to a dedicated worker
+					if strings.HasPrefix(a.Entrypoint(), "smallweb:") {
+						return fmt.Errorf("cron job %s can only be triggered by smallweb up", cronJobID(a, job))
+					}
+
+					wk, err := newWorker(a)
+					if err != nil {
+						return fmt.Errorf("failed to create worker: %w", err)
+					}
+					wk.Logs = logStore
+
+					if err := wk.StartServer(); err != nil {
+						return fmt.Errorf("failed to start worker: %w", err)
+					}
+					defer wk.StopServer()
+
+					handler = wk
+				}
+
+				run, err := runCronJob(ctx, db, logStore, handler, a, job, database.CronSourceManual, os.Stdout, os.Stderr)
+				if err != nil {
+					return err
 				}
 
-				for _, job := range jobs {
-					completions = append(completions, fmt.Sprintf("%s\t%s", job.ID, job.Description))
+				if run.Status == database.CronRunSkipped {
+					return fmt.Errorf("cron job %s skipped: %s", run.Job, run.Error)
 				}
+
+				return nil
 			}
 
-			return completions, cobra.ShellCompDirectiveDefault
+			return fmt.Errorf("could not find job")
 		},
+	}
+
+	return cmd
+}
+
+func NewCmdCronHistory(db *sql.DB) *cobra.Command {
+	var flags struct {
+		limit int
+		json  bool
+	}
+
+	cmd := &cobra.Command{
+		Use:               "history [id]",
+		Short:             "List the runs of cron jobs",
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: completeCronJob,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			rootDir := utils.ExpandTilde(k.String("dir"))
-			parts := strings.Split(args[0], ":")
-			if len(parts) != 2 {
-				return fmt.Errorf("invalid job name")
+			var job string
+			if len(args) > 0 {
+				job = args[0]
 			}
 
-			appname, jobName := parts[0], parts[1]
-			app, err := app.LoadApp(filepath.Join(rootDir, appname), k.String("domain"))
+			runs, err := database.ListCronRuns(db, job, flags.limit)
 			if err != nil {
-				return fmt.Errorf("failed to get app: %w", err)
+				return fmt.Errorf("failed to list cron runs: %w", err)
+			}
+
+			if flags.json {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetEscapeHTML(false)
+				if isatty.IsTerminal(os.Stdout.Fd()) {
+					encoder.SetIndent("", "  ")
+				}
+
+				if err := encoder.Encode(runs); err != nil {
+					return fmt.Errorf("failed to encode cron runs: %w", err)
+				}
+				return nil
+			}
+
+			if len(runs) == 0 {
+				cmd.Println("No cron runs found")
+				return nil
+			}
+
+			var printer tableprinter.TablePrinter
+			if isatty.IsTerminal(os.Stdout.Fd()) {
+				width, _, err := term.GetSize(int(os.Stdout.Fd()))
+				if err != nil {
+					return fmt.Errorf("failed to get terminal size: %w", err)
+				}
+
+				printer = tableprinter.New(os.Stdout, true, width)
+			} else {
+				printer = tableprinter.New(os.Stdout, false, 0)
+			}
+
+			printer.AddHeader([]string{"ID", "Job", "Source", "Status", "Start Time", "Duration", "Exit Code"})
+			for _, run := range runs {
+				printer.AddField(run.ID)
+				printer.AddField(run.Job)
+				printer.AddField(run.Source)
+				printer.AddField(run.Status)
+				printer.AddField(run.StartedAt.Format("2006-01-02 15:04:05"))
+				if run.EndedAt != nil {
+					printer.AddField(run.EndedAt.Sub(run.StartedAt).Round(time.Millisecond).String())
+				} else {
+					printer.AddField("")
+				}
+				if run.ExitCode != nil {
+					printer.AddField(strconv.Itoa(*run.ExitCode))
+				} else if run.StatusCode != nil {
+					printer.AddField(fmt.Sprintf("HTTP %d", *run.StatusCode))
+				} else {
+					printer.AddField("")
+				}
+				printer.EndRow()
+			}
+
+			return printer.Render()
+		},
+	}
+
+	cmd.Flags().IntVarP(&flags.limit, "limit", "n", 20, "maximum number of runs to show, 0 for all")
+	cmd.Flags().BoolVarP(&flags.json, "json", "j", false, "output as JSON")
+	return cmd
+}
+
+func NewCmdCronLogs(db *sql.DB) *cobra.Command {
+	var flags struct {
+		json bool
+	}
+
+	cmd := &cobra.Command{
+		Use:   "logs <run-id>",
+		Short: "Show the output of a cron run",
+		Args:  cobra.ExactArgs(1),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) > 0 {
+				return nil, cobra.ShellCompDirectiveNoFileComp
 			}
 
-			crons, err := ListCronItems(app)
+			runs, err := database.ListCronRuns(db, "", 20)
 			if err != nil {
-				return fmt.Errorf("failed to list cron jobs: %w", err)
+				return nil, cobra.ShellCompDirectiveError
 			}
 
-			for _, cron := range crons {
-				if cron.Name != jobName {
-					continue
+			var completions []string
+			for _, run := range runs {
+				completions = append(completions, fmt.Sprintf("%s\t%s %s", run.ID, run.Job, run.StartedAt.Format("2006-01-02 15:04:05")))
+			}
+
+			return completions, cobra.ShellCompDirectiveNoFileComp
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			run, err := database.GetCronRun(db, args[0])
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return fmt.Errorf("cron run %s not found", args[0])
 				}
 
-				w := worker.NewWorker(app, k.StringMap("env"))
-				command, err := w.Command(cron.Args...)
-				if err != nil {
-					return fmt.Errorf("failed to create command: %w", err)
+				return fmt.Errorf("failed to get cron run: %w", err)
+			}
+
+			if flags.json {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetEscapeHTML(false)
+				if isatty.IsTerminal(os.Stdout.Fd()) {
+					encoder.SetIndent("", "  ")
 				}
 
-				command.Stdout = os.Stdout
-				command.Stderr = os.Stderr
-				if err := command.Run(); err != nil {
-					return fmt.Errorf("failed to run command: %w", err)
+				if err := encoder.Encode(run); err != nil {
+					return fmt.Errorf("failed to encode cron run: %w", err)
 				}
+				return nil
 			}
 
-			return fmt.Errorf("could not find job")
+			os.Stdout.WriteString(run.Stdout)
+			os.Stderr.WriteString(run.Stderr)
+			if run.Error != "" {
+				fmt.Fprintf(os.Stderr, "error: %s\n", run.Error)
+			}
 
+			return nil
 		},
 	}
 
+	cmd.Flags().BoolVarP(&flags.json, "json", "j", false, "output as JSON")
 	return cmd
-
 }
@@ -0,0 +1,412 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/adrg/xdg"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+	"github.com/pomdtr/smallweb/app"
+	"github.com/pomdtr/smallweb/database"
+	"github.com/pomdtr/smallweb/logs"
+	"github.com/pomdtr/smallweb/worker"
+)
+
+// maxCronOutput is the size of the output kept in the history of a run, for
+// each stream.
+const maxCronOutput = 64 * 1024
+
+func cronJobID(a app.App, job app.CronJob) string {
+	return fmt.Sprintf("%s:%s", a.Name, job.Name)
+}
+
+// defaultRetryDelay is the delay before the first retry of a failed job, it
+// doubles after each attempt.
+const defaultRetryDelay = 10 * time.Second
+
+// errCronTimeout is returned when a job exceeds its timeout.
+var errCronTimeout = errors.New("cron job timed out")
+
+// runCronJob runs a cron job of the app, according to its concurrency
+// policy, timeout and retries. Each attempt is recorded in the database, and
+// the last one is returned. The output is written to the app logs, and copied
+// to stdout and stderr if they are not nil. Jobs with a path are sent as a
+// request to the handler instead.
+func runCronJob(ctx context.Context, db *sql.DB, logStore *logs.Store, handler http.Handler, a app.App, job app.CronJob, source string, stdout io.Writer, stderr io.Writer) (*database.CronRun, error) {
+	unlock, ok, err := lockCronJob(a, job)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		run, err := newCronRun(a, job, source, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		run.Status = database.CronRunSkipped
+		run.Error = "previous run still in progress"
+		run.EndedAt = &run.StartedAt
+		if err := database.InsertCronRun(db, run); err != nil {
+			return nil, fmt.Errorf("failed to record cron run: %w", err)
+		}
+
+		log.Printf("skipping cron job %s: previous run still in progress", run.Job)
+		return run, nil
+	}
+	defer unlock()
+
+	delay := time.Duration(job.RetryDelay)
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+
+	for attempt := 1; ; attempt++ {
+		run, err := runCronAttempt(ctx, db, logStore, handler, a, job, source, attempt, stdout, stderr)
+		if run == nil || err == nil {
+			return run, err
+		}
+
+		if attempt > job.Retries {
+			if job.Retries > 0 {
+				log.Printf("cron job %s failed after %d attempts: %v", run.Job, attempt, err)
+				return run, fmt.Errorf("cron job %s failed after %d attempts: %w", run.Job, attempt, err)
+			}
+
+			return run, err
+		}
+
+		log.Printf("cron job %s failed, retrying in %s: %v", run.Job, delay, err)
+		select {
+		case <-ctx.Done():
+			return run, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func newCronRun(a app.App, job app.CronJob, source string, attempt int) (*database.CronRun, error) {
+	runID, err := gonanoid.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate run ID: %w", err)
+	}
+
+	return &database.CronRun{
+		ID:        runID,
+		Job:       cronJobID(a, job),
+		App:       a.Name,
+		Source:    source,
+		Status:    database.CronRunRunning,
+		Attempt:   attempt,
+		StartedAt: time.Now(),
+	}, nil
+}
+
+// runCronAttempt runs the job once. The returned run is nil if it could not
+// be recorded.
+func runCronAttempt(ctx context.Context, db *sql.DB, logStore *logs.Store, handler http.Handler, a app.App, job app.CronJob, source string, attempt int, stdout io.Writer, stderr io.Writer) (*database.CronRun, error) {
+	run, err := newCronRun(a, job, source, attempt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := database.InsertCronRun(db, run); err != nil {
+		return nil, fmt.Errorf("failed to record cron run: %w", err)
+	}
+
+	stdoutBuffer := &truncatedBuffer{max: maxCronOutput}
+	stderrBuffer := &truncatedBuffer{max: maxCronOutput}
+	runErr := func() error {
+		if job.Path != "" {
+			writers := []io.Writer{stdoutBuffer}
+			if stdout != nil {
+				writers = append(writers, stdout)
+			}
+
+			statusCode, err := runCronRequest(ctx, handler, a, job, io.MultiWriter(writers...))
+			if statusCode != 0 {
+				run.StatusCode = &statusCode
+			}
+
+			return err
+		}
+
+		wk, err := newWorker(a)
+		if err != nil {
+			return fmt.Errorf("failed to create worker: %w", err)
+		}
+
+		command, err := wk.Command(job.Args...)
+		if err != nil {
+			return fmt.Errorf("failed to create command: %w", err)
+		}
+
+		stdoutLog := logStore.Writer(a.Name, logs.StreamStdout)
+		defer stdoutLog.Close()
+		stderrLog := logStore.Writer(a.Name, logs.StreamStderr)
+		defer stderrLog.Close()
+
+		stdoutWriters := []io.Writer{stdoutBuffer, stdoutLog}
+		if stdout != nil {
+			stdoutWriters = append(stdoutWriters, stdout)
+		}
+
+		stderrWriters := []io.Writer{stderrBuffer, stderrLog}
+		if stderr != nil {
+			stderrWriters = append(stderrWriters, stderr)
+		}
+
+		command.Stdout = io.MultiWriter(stdoutWriters...)
+		command.Stderr = io.MultiWriter(stderrWriters...)
+		return runWithTimeout(ctx, wk, command, time.Duration(job.Timeout))
+	}()
+
+	endedAt := time.Now()
+	run.EndedAt = &endedAt
+	run.Stdout = stdoutBuffer.String()
+	run.Stderr = stderrBuffer.String()
+	run.Status = database.CronRunSuccess
+
+	var exitErr *exec.ExitError
+	if errors.As(runErr, &exitErr) {
+		exitCode := exitErr.ExitCode()
+		run.ExitCode = &exitCode
+	} else if runErr == nil && job.Path == "" {
+		exitCode := 0
+		run.ExitCode = &exitCode
+	}
+
+	if errors.Is(runErr, errCronTimeout) {
+		run.Status = database.CronRunTimeout
+		run.Error = fmt.Sprintf("timed out after %s", time.Duration(job.Timeout))
+	} else if runErr != nil {
+		run.Status = database.CronRunFailed
+		run.Error = runErr.Error()
+	}
+
+	if err := database.UpdateCronRun(db, run); err != nil {
+		log.Printf("failed to record cron run %s: %v", run.ID, err)
+	}
+
+	if runErr != nil {
+		return run, fmt.Errorf("cron job %s failed: %s", run.Job, run.Error)
+	}
+
+	return run, nil
+}
+
+// runCronRequest sends the request of the job to the app, through the same
+// handler as the requests received by smallweb up, and returns the response
+// status. The response body is written to stdout.
+func runCronRequest(ctx context.Context, handler http.Handler, a app.App, job app.CronJob, stdout io.Writer) (int, error) {
+	if timeout := time.Duration(job.Timeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, timeout, errCronTimeout)
+		defer cancel()
+	}
+
+	r, err := newCronRequest(ctx, a, job)
+	if err != nil {
+		return 0, err
+	}
+
+	w := &cronResponseWriter{header: http.Header{}, body: stdout}
+	handler.ServeHTTP(w, r)
+	if err := context.Cause(ctx); err != nil {
+		return w.statusCode, err
+	}
+
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+
+	if w.statusCode >= http.StatusBadRequest {
+		return w.statusCode, fmt.Errorf("app responded with status %d", w.statusCode)
+	}
+
+	return w.statusCode, nil
+}
+
+// newCronRequest builds the request of the job, as if it was received by the
+// server on the url of the app. The caller is identified as a cron job, so
+// that private routes can be reached.
+func newCronRequest(ctx context.Context, a app.App, job app.CronJob) (*http.Request, error) {
+	if !strings.HasPrefix(job.Path, "/") {
+		return nil, fmt.Errorf("invalid path for cron job %s: %s", cronJobID(a, job), job.Path)
+	}
+
+	method := job.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	// like the requests received by the server, the body is never nil
+	var body io.Reader = http.NoBody
+	if job.Body != "" {
+		body = strings.NewReader(job.Body)
+	}
+
+	ctx = worker.WithIdentity(ctx, worker.Identity{Method: worker.AuthMethodCron})
+	r, err := http.NewRequestWithContext(ctx, strings.ToUpper(method), job.Path, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// the url of the app may use a custom domain registered by another app,
+	// while its subdomain is always routed to it
+	r.Host = fmt.Sprintf("%s.%s", a.Name, k.String("domain"))
+	r.RequestURI = job.Path
+	r.RemoteAddr = "127.0.0.1:0"
+	for key, value := range job.Headers {
+		r.Header.Set(key, value)
+	}
+
+	return r, nil
+}
+
+// cronResponseWriter records the status of the response, and copies its body.
+type cronResponseWriter struct {
+	header     http.Header
+	body       io.Writer
+	statusCode int
+}
+
+func (me *cronResponseWriter) Header() http.Header {
+	return me.header
+}
+
+func (me *cronResponseWriter) WriteHeader(statusCode int) {
+	if me.statusCode == 0 {
+		me.statusCode = statusCode
+	}
+}
+
+func (me *cronResponseWriter) Write(p []byte) (int, error) {
+	me.WriteHeader(http.StatusOK)
+	return me.body.Write(p)
+}
+
+func (me *cronResponseWriter) Flush() {}
+
+// runWithTimeout runs the command of the worker, and stops it if it exceeds
+// the timeout or the context is cancelled. The process is killed if it does
+// not exit within 5 seconds of being interrupted.
+func runWithTimeout(ctx context.Context, wk *worker.Worker, command *exec.Cmd, timeout time.Duration) error {
+	if err := wk.Start(command); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- command.Wait()
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var stopErr error
+	select {
+	case err := <-done:
+		return err
+	case <-expired:
+		stopErr = errCronTimeout
+	case <-ctx.Done():
+		stopErr = ctx.Err()
+	}
+
+	command.Process.Signal(os.Interrupt)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		command.Process.Kill()
+		<-done
+	}
+
+	return stopErr
+}
+
+// lockCronJob enforces the concurrency policy of the job, using a file lock
+// so that runs triggered from the cli are taken into account. If ok is false,
+// the run must be skipped.
+func lockCronJob(a app.App, job app.CronJob) (unlock func(), ok bool, err error) {
+	var how int
+	switch job.Concurrency {
+	case "", app.ConcurrencyAllow:
+		return func() {}, true, nil
+	case app.ConcurrencySkip:
+		how = syscall.LOCK_EX | syscall.LOCK_NB
+	case app.ConcurrencyQueue:
+		how = syscall.LOCK_EX
+	default:
+		return nil, false, fmt.Errorf("invalid concurrency policy for cron job %s: %s", cronJobID(a, job), job.Concurrency)
+	}
+
+	// job names are validated when the app is loaded, they are escaped anyway
+	// so that a lock can never be created outside of the cron directory
+	lockPath := filepath.Join(xdg.DataHome, "smallweb", "cron", url.PathEscape(a.Name), url.PathEscape(job.Name)+".lock")
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0755); err != nil {
+		return nil, false, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, false, nil
+		}
+
+		return nil, false, fmt.Errorf("failed to lock cron job: %w", err)
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, true, nil
+}
+
+// truncatedBuffer keeps the first bytes written to it, and drops the rest.
+type truncatedBuffer struct {
+	max       int
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (me *truncatedBuffer) Write(p []byte) (int, error) {
+	if remaining := me.max - me.buf.Len(); remaining < len(p) {
+		me.buf.Write(p[:max(remaining, 0)])
+		me.truncated = true
+		return len(p), nil
+	}
+
+	return me.buf.Write(p)
+}
+
+func (me *truncatedBuffer) String() string {
+	if me.truncated {
+		return me.buf.String() + "\n[output truncated]\n"
+	}
+
+	return me.buf.String()
+}
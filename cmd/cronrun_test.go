@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pomdtr/smallweb/app"
+	"github.com/pomdtr/smallweb/database"
+	"github.com/pomdtr/smallweb/worker"
+)
+
+func TestNewCronRequest(t *testing.T) {
+	k.Set("domain", "example.com")
+	defer k.Delete("domain")
+
+	// the custom domain of the app may be served by another app
+	a := app.App{Name: "blog", Url: "https://shared.org/", Domains: []string{"shared.org"}}
+
+	r, err := newCronRequest(context.Background(), a, app.CronJob{Name: "refresh", Path: "/api/refresh?full=false", Method: "post", Headers: map[string]string{"Content-Type": "application/json"}, Body: `{}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Host != "blog.example.com" || r.Method != http.MethodPost || r.URL.Path != "/api/refresh" || r.URL.RawQuery != "full=false" {
+		t.Errorf("got %s %s%s", r.Method, r.Host, r.URL)
+	}
+
+	if r.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got headers %v", r.Header)
+	}
+
+	if body, _ := io.ReadAll(r.Body); string(body) != `{}` {
+		t.Errorf("got body %q", body)
+	}
+
+	if identity, ok := worker.IdentityFromContext(r.Context()); !ok || identity.Method != worker.AuthMethodCron {
+		t.Errorf("got identity %+v", identity)
+	}
+
+	r, err = newCronRequest(context.Background(), a, app.CronJob{Name: "ping", Path: "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Method != http.MethodGet || r.Body != http.NoBody {
+		t.Errorf("got method %s and body %v", r.Method, r.Body)
+	}
+
+	if _, err := newCronRequest(context.Background(), a, app.CronJob{Name: "invalid", Path: "api/refresh"}); err == nil {
+		t.Error("expected an error for a relative path")
+	}
+}
+
+func TestTruncatedBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{name: "short output", writes: []string{"hey", " you"}, want: "hey you"},
+		{name: "exactly the limit", writes: []string{"0123", "4567"}, want: "01234567"},
+		{name: "over the limit", writes: []string{"0123456", "789"}, want: "01234567\n[output truncated]\n"},
+		{name: "writes after the limit", writes: []string{"01234567", "8", "9"}, want: "01234567\n[output truncated]\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &truncatedBuffer{max: 8}
+			for _, w := range tt.writes {
+				// the writer must not fail, as it would interrupt the job
+				if n, err := buf.Write([]byte(w)); err != nil || n != len(w) {
+					t.Fatalf("got %d, %v", n, err)
+				}
+			}
+
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunCronJobRecordsHistory(t *testing.T) {
+	db := openTestDB(t)
+	k.Set("domain", "example.com")
+	defer k.Delete("domain")
+
+	a := app.App{Name: "blog"}
+	output := strings.Repeat("a", 2*maxCronOutput)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/verbose":
+			io.WriteString(w, output)
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, "oops")
+		}
+	})
+
+	run, err := runCronJob(context.Background(), db, nil, handler, a, app.CronJob{Name: "verbose", Path: "/verbose"}, database.CronSourceManual, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runs, err := database.ListCronRuns(db, "blog:verbose", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(runs) != 1 || runs[0].ID != run.ID {
+		t.Fatalf("got runs %v, want the run to be recorded", runs)
+	}
+
+	recorded := runs[0]
+	if recorded.Status != database.CronRunSuccess || recorded.Source != database.CronSourceManual || recorded.Attempt != 1 || recorded.EndedAt == nil {
+		t.Errorf("got run %+v", recorded)
+	}
+
+	if recorded.StatusCode == nil || *recorded.StatusCode != http.StatusOK {
+		t.Errorf("got status code %v, want %d", recorded.StatusCode, http.StatusOK)
+	}
+
+	if want := output[:maxCronOutput] + "\n[output truncated]\n"; recorded.Stdout != want {
+		t.Errorf("got %d bytes of output, want it to be truncated to %d", len(recorded.Stdout), maxCronOutput)
+	}
+
+	// each attempt of a failing job is recorded
+	job := app.CronJob{Name: "broken", Path: "/broken", Retries: 1, RetryDelay: app.Duration(time.Millisecond)}
+	if _, err := runCronJob(context.Background(), db, nil, handler, a, job, database.CronSourceManual, nil, nil); err == nil {
+		t.Fatal("expected the job to fail")
+	}
+
+	runs, err = database.ListCronRuns(db, "blog:broken", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(runs) != 2 {
+		t.Fatalf("got %d runs, want 2", len(runs))
+	}
+
+	for i, run := range runs {
+		if run.Status != database.CronRunFailed || run.Attempt != 2-i || run.Stdout != "oops" || run.StatusCode == nil || *run.StatusCode != http.StatusInternalServerError {
+			t.Errorf("got run %+v", run)
+		}
+	}
+}
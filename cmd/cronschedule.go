@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // the timezone database may be missing from the host
+
+	"github.com/pomdtr/smallweb/app"
+	"github.com/robfig/cron/v3"
+)
+
+var cronParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// allHours is the hour field of a schedule running every hour.
+const allHours = 1<<24 - 1
+
+// parseCronSchedule parses the schedule of the job in its timezone, which
+// defaults to the timezone of the global config, then to the local one. A
+// CRON_TZ prefix in the schedule takes precedence.
+func parseCronSchedule(job app.CronJob) (cron.Schedule, error) {
+	spec := job.Schedule
+	timezone := job.Timezone
+	if timezone == "" {
+		timezone = k.String("timezone")
+	}
+
+	if timezone != "" && !strings.HasPrefix(spec, "CRON_TZ=") && !strings.HasPrefix(spec, "TZ=") {
+		spec = fmt.Sprintf("CRON_TZ=%s %s", timezone, spec)
+	}
+
+	schedule, err := cronParser.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule for cron job %s: %w", job.Name, err)
+	}
+
+	if spec, ok := schedule.(*cron.SpecSchedule); ok {
+		return dstSchedule{spec}, nil
+	}
+
+	return schedule, nil
+}
+
+// cronLocation returns the timezone the schedule is evaluated in.
+func cronLocation(schedule cron.Schedule) *time.Location {
+	if schedule, ok := schedule.(dstSchedule); ok {
+		return schedule.Location
+	}
+
+	return time.Local
+}
+
+// dstSchedule handles daylight saving time transitions like cron does: a job
+// scheduled during the skipped hour runs right after the clocks are set
+// forward, and a job scheduled during the repeated hour only runs once. Jobs
+// running every hour are not affected.
+type dstSchedule struct {
+	*cron.SpecSchedule
+}
+
+func (me dstSchedule) Next(t time.Time) time.Time {
+	next := me.SpecSchedule.Next(t)
+	if next.IsZero() || me.Hour&allHours == allHours {
+		return next
+	}
+
+	if transition, gap, ok := forwardTransition(t, next, me.Location); ok {
+		// evaluate the schedule as if the clocks were not set forward
+		_, offset := t.In(me.Location).Zone()
+		skipped := *me.SpecSchedule
+		skipped.Location = time.FixedZone("", offset)
+		if skipped.Next(transition.Add(-time.Second)).Before(transition.Add(gap)) {
+			return transition.In(t.Location())
+		}
+	}
+
+	if me.isRepeated(next) {
+		return me.Next(next)
+	}
+
+	return next
+}
+
+// isRepeated reports whether t is the second occurrence of a wall clock time
+// the job already ran at, after the clocks were set back.
+func (me dstSchedule) isRepeated(t time.Time) bool {
+	_, offset := t.In(me.Location).Zone()
+	_, previousOffset := t.Add(-3 * time.Hour).In(me.Location).Zone()
+	if previousOffset <= offset {
+		return false
+	}
+
+	earlier := t.Add(-time.Duration(previousOffset-offset) * time.Second)
+	if earlier.In(me.Location).Format(time.TimeOnly) != t.In(me.Location).Format(time.TimeOnly) {
+		return false
+	}
+
+	return me.SpecSchedule.Next(earlier.Add(-time.Second)).Equal(earlier)
+}
+
+// forwardTransition returns the instant the clocks are set forward between
+// from and to, and by how much.
+func forwardTransition(from time.Time, to time.Time, location *time.Location) (time.Time, time.Duration, bool) {
+	_, fromOffset := from.In(location).Zone()
+	_, toOffset := to.In(location).Zone()
+	if toOffset <= fromOffset {
+		return time.Time{}, 0, false
+	}
+
+	lo, hi := from.Unix(), to.Unix()
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if _, offset := time.Unix(mid, 0).In(location).Zone(); offset == fromOffset {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	return time.Unix(hi, 0), time.Duration(toOffset-fromOffset) * time.Second, true
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pomdtr/smallweb/app"
+)
+
+func TestParseCronScheduleDST(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		schedule string
+		from     time.Time
+		want     []time.Time
+	}{
+		{
+			name:     "regular day",
+			schedule: "30 2 * * *",
+			from:     time.Date(2024, 5, 10, 0, 0, 0, 0, paris),
+			want: []time.Time{
+				time.Date(2024, 5, 10, 2, 30, 0, 0, paris),
+				time.Date(2024, 5, 11, 2, 30, 0, 0, paris),
+			},
+		},
+		{
+			name:     "spring forward runs after the skipped hour",
+			schedule: "30 2 * * *",
+			from:     time.Date(2024, 3, 31, 0, 0, 0, 0, paris),
+			want: []time.Time{
+				time.Date(2024, 3, 31, 1, 0, 0, 0, time.UTC),
+				time.Date(2024, 4, 1, 2, 30, 0, 0, paris),
+			},
+		},
+		{
+			name:     "fall back runs once in the repeated hour",
+			schedule: "30 2 * * *",
+			from:     time.Date(2024, 10, 27, 0, 0, 0, 0, paris),
+			want: []time.Time{
+				time.Date(2024, 10, 27, 0, 30, 0, 0, time.UTC),
+				time.Date(2024, 10, 28, 2, 30, 0, 0, paris),
+			},
+		},
+		{
+			name:     "hourly jobs run in both repeated hours",
+			schedule: "0 * * * *",
+			from:     time.Date(2024, 10, 27, 1, 30, 0, 0, paris),
+			want: []time.Time{
+				time.Date(2024, 10, 27, 0, 0, 0, 0, time.UTC),
+				time.Date(2024, 10, 27, 1, 0, 0, 0, time.UTC),
+				time.Date(2024, 10, 27, 2, 0, 0, 0, time.UTC),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := parseCronSchedule(app.CronJob{Name: "job", Schedule: tt.schedule, Timezone: "Europe/Paris"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			next := tt.from
+			for _, want := range tt.want {
+				next = schedule.Next(next)
+				if !next.Equal(want) {
+					t.Fatalf("got %s, want %s", next.UTC(), want.UTC())
+				}
+			}
+		})
+	}
+}
+
+func TestParseCronScheduleInvalidTimezone(t *testing.T) {
+	if _, err := parseCronSchedule(app.CronJob{Name: "job", Schedule: "0 9 * * *", Timezone: "Mars/Olympus"}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/cli/go-gh/v2/pkg/tableprinter"
+	"github.com/mattn/go-isatty"
+	"github.com/pomdtr/smallweb/database"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+func NewCmdDB(db *sql.DB) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "db",
+		Short:   "Manage the smallweb database",
+		GroupID: CoreGroupID,
+	}
+
+	cmd.AddCommand(NewCmdDBMigrate(db))
+	cmd.AddCommand(NewCmdDBStatus(db))
+	return cmd
+}
+
+func NewCmdDBMigrate(db *sql.DB) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Apply pending database migrations",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			migrations, err := database.Migrate(db)
+			for _, migration := range migrations {
+				cmd.Printf("Applied migration %04d_%s\n", migration.Version, migration.Name)
+			}
+
+			if err != nil {
+				return fmt.Errorf("failed to migrate database: %w", err)
+			}
+
+			if len(migrations) == 0 {
+				cmd.Println("Database is up to date")
+			}
+
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+func NewCmdDBStatus(db *sql.DB) *cobra.Command {
+	var flags struct {
+		json bool
+	}
+
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "List database migrations",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			statuses, err := database.Status(db)
+			if err != nil {
+				return fmt.Errorf("failed to get migration status: %w", err)
+			}
+
+			if flags.json {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetEscapeHTML(false)
+
+				if isatty.IsTerminal(os.Stdout.Fd()) {
+					encoder.SetIndent("", "  ")
+				}
+
+				if err := encoder.Encode(statuses); err != nil {
+					return fmt.Errorf("failed to encode migrations: %w", err)
+				}
+
+				return nil
+			}
+
+			var printer tableprinter.TablePrinter
+			if isatty.IsTerminal(os.Stdout.Fd()) {
+				width, _, err := term.GetSize(int(os.Stdout.Fd()))
+				if err != nil {
+					return fmt.Errorf("failed to get terminal size: %w", err)
+				}
+
+				printer = tableprinter.New(os.Stdout, true, width)
+			} else {
+				printer = tableprinter.New(os.Stdout, false, 0)
+			}
+
+			printer.AddHeader([]string{"Version", "Name", "Applied At"})
+			for _, status := range statuses {
+				printer.AddField(fmt.Sprintf("%04d", status.Version))
+				printer.AddField(status.Name)
+				if status.AppliedAt != nil {
+					printer.AddField(status.AppliedAt.Format("2006-01-02 15:04:05"))
+				} else {
+					printer.AddField("Pending")
+				}
+				printer.EndRow()
+			}
+
+			return printer.Render()
+		},
+	}
+
+	cmd.Flags().BoolVarP(&flags.json, "json", "j", false, "output as JSON")
+	return cmd
+}
+
+// migrateDB applies the pending migrations, before running a command which
+// uses the database.
+func migrateDB(db *sql.DB) error {
+	if _, err := database.Migrate(db); err != nil {
+		return fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/pomdtr/smallweb/database"
+)
+
+// openTestDB opens a migrated database, removed once the test is done.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := database.OpenDB(filepath.Join(t.TempDir(), "smallweb.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := database.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
@@ -3,4 +3,16 @@ declare namespace Smallweb {
         fetch?(req: Request): Response | Promise<Response>;
         run?: (args: string[]) => void | Promise<void>;
     }
+
+    /**
+     * Headers set by smallweb on requests to private routes, once the caller
+     * is authenticated. Values supplied by the client are always stripped.
+     */
+    interface IdentityHeaders {
+        "x-smallweb-auth-method": "session" | "token" | "cron";
+        /** Set when the caller signed in using the oidc provider */
+        "x-smallweb-email"?: string;
+        /** Set when the caller used an api token */
+        "x-smallweb-token-id"?: string;
+    }
 }
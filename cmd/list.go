@@ -11,6 +11,7 @@ import (
 	"github.com/mattn/go-isatty"
 	"github.com/pomdtr/smallweb/app"
 	"github.com/pomdtr/smallweb/utils"
+	"github.com/pomdtr/smallweb/watcher"
 	"github.com/spf13/cobra"
 	"golang.org/x/term"
 )
@@ -42,6 +43,9 @@ func NewCmdList() *cobra.Command {
 				apps = append(apps, a)
 			}
 
+			domains := watcher.IndexDomains(apps, k.String("domain"), k.String("authDomain"))
+			watcher.ResolveUrls(apps, k.String("domain"), domains)
+
 			if flags.json {
 				encoder := json.NewEncoder(os.Stdout)
 				encoder.SetEscapeHTML(false)
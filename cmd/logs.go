@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/adrg/xdg"
+	"github.com/pomdtr/smallweb/logs"
+	"github.com/pomdtr/smallweb/utils"
+	"github.com/spf13/cobra"
+)
+
+func newLogStore() (*logs.Store, error) {
+	return logs.NewStore(filepath.Join(xdg.DataHome, "smallweb", "logs"))
+}
+
+func NewCmdLogs() *cobra.Command {
+	var flags struct {
+		follow bool
+		since  string
+		json   bool
+	}
+
+	cmd := &cobra.Command{
+		Use:               "logs <app>",
+		Short:             "Show the output of an app",
+		GroupID:           CoreGroupID,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeApp(utils.ExpandTilde(k.String("dir"))),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var since time.Time
+			if flags.since != "" {
+				t, err := parseSince(flags.since)
+				if err != nil {
+					return err
+				}
+				since = t
+			}
+
+			store, err := newLogStore()
+			if err != nil {
+				return err
+			}
+
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer cancel()
+
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetEscapeHTML(false)
+
+			return store.Tail(ctx, args[0], since, flags.follow, func(entry logs.Entry) error {
+				if flags.json {
+					return encoder.Encode(entry)
+				}
+
+				_, err := fmt.Printf("%s [%s] %s\n", entry.Time.Local().Format("2006-01-02 15:04:05"), entry.Stream, entry.Text)
+				return err
+			})
+		},
+	}
+
+	cmd.Flags().BoolVarP(&flags.follow, "follow", "f", false, "wait for new logs")
+	cmd.Flags().StringVar(&flags.since, "since", "", "only show logs since a duration (e.g. 10m) or a date (e.g. 2024-01-01)")
+	cmd.Flags().BoolVarP(&flags.json, "json", "j", false, "output as JSON")
+	return cmd
+}
+
+// parseSince accepts a duration relative to now, or an absolute date.
+func parseSince(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid since value: %s", value)
+}
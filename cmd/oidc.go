@@ -0,0 +1,209 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pomdtr/smallweb/utils"
+	"golang.org/x/oauth2"
+)
+
+// lastlogin does not require clients to be registered, the client id being
+// the url of the app.
+var lastloginDiscovery = oidcDiscovery{
+	Issuer:                "https://lastlogin.net",
+	AuthorizationEndpoint: "https://lastlogin.net/auth",
+	TokenEndpoint:         "https://lastlogin.net/token",
+	UserinfoEndpoint:      "https://lastlogin.net/userinfo",
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// OIDCProvider identifies users using an OpenID Connect provider.
+type OIDCProvider struct {
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	Scopes       []string `json:"scopes"`
+	Claim        string   `json:"claim"`
+	CA           string   `json:"ca"`
+
+	client    *http.Client
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+}
+
+func NewOIDCProvider() (*OIDCProvider, error) {
+	provider := OIDCProvider{
+		Issuer: lastloginDiscovery.Issuer,
+		Claim:  "email",
+	}
+
+	if err := unmarshalConfig("oidc", &provider); err != nil {
+		return nil, err
+	}
+
+	provider.Issuer = strings.TrimSuffix(provider.Issuer, "/")
+	if provider.Issuer == lastloginDiscovery.Issuer {
+		provider.discovery = &lastloginDiscovery
+		if provider.Scopes == nil {
+			provider.Scopes = []string{"email"}
+		}
+	} else {
+		if provider.ClientID == "" {
+			return nil, fmt.Errorf("oidc clientId is required when using a custom issuer")
+		}
+
+		if provider.Scopes == nil {
+			provider.Scopes = []string{"openid", "email"}
+		}
+	}
+
+	client, err := utils.NewHTTPClient(provider.CA)
+	if err != nil {
+		return nil, fmt.Errorf("invalid oidc CA: %w", err)
+	}
+	provider.client = client
+
+	return &provider, nil
+}
+
+// Discover fetches the provider metadata. It is only fetched once, but a
+// failed attempt is retried on the next call.
+func (me *OIDCProvider) Discover(ctx context.Context) (*oidcDiscovery, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if me.discovery != nil {
+		return me.discovery, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", me.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create discovery request: %w", err)
+	}
+
+	resp, err := me.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute discovery request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery request failed: %s", resp.Status)
+	}
+
+	var discovery oidcDiscovery
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return nil, fmt.Errorf("failed to decode discovery document: %w", err)
+	}
+
+	if strings.TrimSuffix(discovery.Issuer, "/") != me.Issuer {
+		return nil, fmt.Errorf("issuer mismatch: %s != %s", discovery.Issuer, me.Issuer)
+	}
+
+	me.discovery = &discovery
+	return me.discovery, nil
+}
+
+// Config returns the oauth2 config used to sign in to the app served at host.
+func (me *OIDCProvider) Config(ctx context.Context, host string) (*oauth2.Config, error) {
+	discovery, err := me.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	clientID := me.ClientID
+	if clientID == "" {
+		clientID = fmt.Sprintf("https://%s/", host)
+	}
+
+	authStyle := oauth2.AuthStyleAutoDetect
+	if me.ClientSecret == "" {
+		authStyle = oauth2.AuthStyleInParams
+	}
+
+	return &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: me.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   discovery.AuthorizationEndpoint,
+			TokenURL:  discovery.TokenEndpoint,
+			AuthStyle: authStyle,
+		},
+		Scopes:      me.Scopes,
+		RedirectURL: fmt.Sprintf("https://%s/_auth/callback", host),
+	}, nil
+}
+
+// Exchange trades the authorization code for an access token, and returns
+// the identity of the user, read from the configured userinfo claim. The
+// login fails if the email of the user is not verified.
+func (me *OIDCProvider) Exchange(ctx context.Context, config *oauth2.Config, code string) (string, error) {
+	discovery, err := me.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, me.client)
+	token, err := config.Exchange(ctx, code)
+	if err != nil {
+		return "", fmt.Errorf("failed to exchange code: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", discovery.UserinfoEndpoint, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create userinfo request: %w", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+
+	resp, err := me.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to execute userinfo request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("userinfo request failed: %s", resp.Status)
+	}
+
+	var userinfo map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&userinfo); err != nil {
+		return "", fmt.Errorf("failed to decode userinfo: %w", err)
+	}
+
+	return userinfoIdentity(userinfo, me.Claim)
+}
+
+// userinfoIdentity reads the identity of the user from the claim of the
+// userinfo response. Users whose email is explicitly not verified are
+// rejected, as anyone could otherwise sign in using the email of the owner.
+func userinfoIdentity(userinfo map[string]any, claim string) (string, error) {
+	switch verified := userinfo["email_verified"].(type) {
+	case bool:
+		if !verified {
+			return "", fmt.Errorf("email is not verified")
+		}
+	case string:
+		// some providers send the claim as a string
+		if verified == "false" {
+			return "", fmt.Errorf("email is not verified")
+		}
+	}
+
+	identity, ok := userinfo[claim].(string)
+	if !ok || identity == "" {
+		return "", fmt.Errorf("claim %s not found in userinfo", claim)
+	}
+
+	return identity, nil
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import "testing"
+
+func TestUserinfoIdentity(t *testing.T) {
+	tests := []struct {
+		name     string
+		userinfo map[string]any
+		claim    string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "verified email",
+			userinfo: map[string]any{"email": "pomdtr@example.com", "email_verified": true},
+			claim:    "email",
+			want:     "pomdtr@example.com",
+		},
+		{
+			name:     "email_verified missing",
+			userinfo: map[string]any{"email": "pomdtr@example.com"},
+			claim:    "email",
+			want:     "pomdtr@example.com",
+		},
+		{
+			name:     "unverified email",
+			userinfo: map[string]any{"email": "pomdtr@example.com", "email_verified": false},
+			claim:    "email",
+			wantErr:  true,
+		},
+		{
+			name:     "unverified email as a string",
+			userinfo: map[string]any{"email": "pomdtr@example.com", "email_verified": "false"},
+			claim:    "email",
+			wantErr:  true,
+		},
+		{
+			name:     "custom claim",
+			userinfo: map[string]any{"sub": "1234", "email_verified": true},
+			claim:    "sub",
+			want:     "1234",
+		},
+		{
+			name:     "missing claim",
+			userinfo: map[string]any{"sub": "1234"},
+			claim:    "email",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := userinfoIdentity(tt.userinfo, tt.claim)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
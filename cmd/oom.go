@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/cli/go-gh/v2/pkg/tableprinter"
+	"github.com/mattn/go-isatty"
+	"github.com/pomdtr/smallweb/database"
+	"github.com/pomdtr/smallweb/utils"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+func NewCmdOOM(db *sql.DB) *cobra.Command {
+	var flags struct {
+		json bool
+	}
+
+	cmd := &cobra.Command{
+		Use:               "oom [app]",
+		Short:             "List app workers killed for exceeding their memory limits",
+		GroupID:           CoreGroupID,
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: completeApp(utils.ExpandTilde(k.String("dir"))),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return migrateDB(db)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var appname string
+			if len(args) > 0 {
+				appname = args[0]
+			}
+
+			kills, err := database.ListOOMKills(db, appname)
+			if err != nil {
+				return fmt.Errorf("failed to list oom kills: %w", err)
+			}
+
+			if flags.json {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetEscapeHTML(false)
+
+				if isatty.IsTerminal(os.Stdout.Fd()) {
+					encoder.SetIndent("", "  ")
+				}
+
+				if err := encoder.Encode(kills); err != nil {
+					return fmt.Errorf("failed to encode oom kills: %w", err)
+				}
+
+				return nil
+			}
+
+			if len(kills) == 0 {
+				fmt.Println("No oom kills found")
+				return nil
+			}
+
+			var printer tableprinter.TablePrinter
+			if isatty.IsTerminal(os.Stdout.Fd()) {
+				width, _, err := term.GetSize(int(os.Stdout.Fd()))
+				if err != nil {
+					return fmt.Errorf("failed to get terminal size: %w", err)
+				}
+
+				printer = tableprinter.New(os.Stdout, true, width)
+			} else {
+				printer = tableprinter.New(os.Stdout, false, 0)
+			}
+
+			printer.AddHeader([]string{"App", "Reason", "Time"})
+			for _, kill := range kills {
+				printer.AddField(kill.App)
+				printer.AddField(kill.Reason)
+				printer.AddField(kill.CreatedAt.Format("2006-01-02 15:04:05"))
+				printer.EndRow()
+			}
+
+			return printer.Render()
+		},
+	}
+
+	cmd.Flags().BoolVarP(&flags.json, "json", "j", false, "output as JSON")
+	return cmd
+}
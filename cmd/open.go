@@ -7,6 +7,7 @@ import (
 	"github.com/cli/browser"
 	"github.com/pomdtr/smallweb/app"
 	"github.com/pomdtr/smallweb/utils"
+	"github.com/pomdtr/smallweb/watcher"
 	"github.com/spf13/cobra"
 )
 
@@ -24,6 +25,30 @@ func NewCmdOpen() *cobra.Command {
 				return fmt.Errorf("failed to load app: %w", err)
 			}
 
+			// the custom domains of the app may be taken by another app
+			names, err := app.ListApps(rootDir)
+			if err != nil {
+				return fmt.Errorf("failed to list apps: %w", err)
+			}
+
+			apps := []app.App{a}
+			for _, name := range names {
+				if name == a.Name {
+					continue
+				}
+
+				other, err := app.LoadApp(filepath.Join(rootDir, name), k.String("domain"))
+				if err != nil {
+					continue
+				}
+
+				apps = append(apps, other)
+			}
+
+			domains := watcher.IndexDomains(apps, k.String("domain"), k.String("authDomain"))
+			watcher.ResolveUrls(apps[:1], k.String("domain"), domains)
+			a = apps[0]
+
 			if err := browser.OpenURL(a.Url); err != nil {
 				return fmt.Errorf("failed to open browser: %w", err)
 			}
@@ -0,0 +1,231 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pomdtr/smallweb/app"
+	"github.com/pomdtr/smallweb/worker"
+	"golang.org/x/time/rate"
+)
+
+// clientIdleTimeout is how long the rate limiter of a client is kept after
+// its last request.
+const clientIdleTimeout = 10 * time.Minute
+
+var errQueueFull = errors.New("too many queued requests")
+
+// rateLimiter enforces the rate limits of each app, before their worker is
+// started.
+type rateLimiter struct {
+	defaults app.RateLimit
+
+	mu   sync.Mutex
+	apps map[string]*appLimiter
+}
+
+type appLimiter struct {
+	config      app.RateLimit
+	concurrency *concurrency
+
+	mu      sync.Mutex
+	clients map[string]*clientLimiter
+}
+
+// concurrency counts the in-flight requests of an app. It outlives the
+// limiter of the app, so that the requests in flight when the config changes
+// count toward the new limit.
+type concurrency struct {
+	mu       sync.Mutex
+	inFlight int
+	queued   int
+	// released is closed each time a request completes, to wake up the
+	// queued requests
+	released chan struct{}
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter() (*rateLimiter, error) {
+	var defaults app.RateLimit
+	if err := unmarshalConfig("rateLimit", &defaults); err != nil {
+		return nil, err
+	}
+
+	return &rateLimiter{
+		defaults: defaults,
+		apps:     make(map[string]*appLimiter),
+	}, nil
+}
+
+// Acquire checks the rate limits of the app, and waits for a slot if too
+// many requests are in flight. If the request is rejected, an error response
+// is written and ok is false. Otherwise, release must be called once the
+// request is served. The requests of cron jobs are never limited.
+func (me *rateLimiter) Acquire(w http.ResponseWriter, r *http.Request, a app.App) (release func(), ok bool) {
+	if identity, ok := worker.IdentityFromContext(r.Context()); ok && identity.Method == worker.AuthMethodCron {
+		return func() {}, true
+	}
+
+	limiter := me.appLimiter(a)
+	if retryAfter, allowed := limiter.allow(clientIP(r)); !allowed {
+		tooManyRequests(w, retryAfter)
+		return nil, false
+	}
+
+	if err := limiter.concurrency.acquire(r.Context(), limiter.config.MaxConcurrentRequests, limiter.config.QueueSize); err != nil {
+		if errors.Is(err, errQueueFull) {
+			tooManyRequests(w, 0)
+			return nil, false
+		}
+
+		// the client is most likely gone, answer anyway so that callers
+		// never have to write the response themselves
+		http.Error(w, "request cancelled while waiting for a slot", http.StatusServiceUnavailable)
+		return nil, false
+	}
+
+	return limiter.concurrency.release, true
+}
+
+// appLimiter returns the limiter of the app, creating a new one if its
+// config changed.
+func (me *rateLimiter) appLimiter(a app.App) *appLimiter {
+	config := a.Config.RateLimit.Merge(me.defaults)
+
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	previous, ok := me.apps[a.Name]
+	if ok && previous.config == config {
+		return previous
+	}
+
+	limiter := &appLimiter{
+		config:  config,
+		clients: make(map[string]*clientLimiter),
+	}
+
+	if ok {
+		limiter.concurrency = previous.concurrency
+	} else {
+		limiter.concurrency = &concurrency{released: make(chan struct{})}
+	}
+
+	me.apps[a.Name] = limiter
+	return limiter
+}
+
+// Remove drops the limiter of a removed app. The requests in flight release
+// their slot on the dropped limiter.
+func (me *rateLimiter) Remove(name string) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	delete(me.apps, name)
+}
+
+// allow consumes a token from the bucket of the client, and returns how long
+// it should wait before retrying if the bucket is empty.
+func (me *appLimiter) allow(ip string) (time.Duration, bool) {
+	if me.config.RequestsPerSecond <= 0 {
+		return 0, true
+	}
+
+	me.mu.Lock()
+	now := time.Now()
+	client, ok := me.clients[ip]
+	if !ok {
+		if len(me.clients) > 4096 {
+			me.prune(now)
+		}
+
+		burst := me.config.Burst
+		if burst <= 0 {
+			burst = int(math.Ceil(me.config.RequestsPerSecond))
+		}
+
+		client = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(me.config.RequestsPerSecond), burst)}
+		me.clients[ip] = client
+	}
+	client.lastSeen = now
+	me.mu.Unlock()
+
+	reservation := client.limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return time.Second, false
+	}
+
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return delay, false
+	}
+
+	return 0, true
+}
+
+// acquire waits until less than max requests are in flight, or fails if
+// queueSize requests are already waiting. A max lower or equal to zero does
+// not limit the number of requests, which are still counted.
+func (me *concurrency) acquire(ctx context.Context, max int, queueSize int) error {
+	me.mu.Lock()
+	if max <= 0 || me.inFlight < max {
+		me.inFlight++
+		me.mu.Unlock()
+		return nil
+	}
+
+	if me.queued >= queueSize {
+		me.mu.Unlock()
+		return errQueueFull
+	}
+
+	me.queued++
+	for {
+		released := me.released
+		me.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			me.mu.Lock()
+			me.queued--
+			me.mu.Unlock()
+			return ctx.Err()
+		}
+
+		me.mu.Lock()
+		if me.inFlight < max {
+			me.inFlight++
+			me.queued--
+			me.mu.Unlock()
+			return nil
+		}
+	}
+}
+
+func (me *concurrency) release() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	me.inFlight--
+	close(me.released)
+	me.released = make(chan struct{})
+}
+
+func (me *appLimiter) prune(now time.Time) {
+	for ip, client := range me.clients {
+		if now.Sub(client.lastSeen) < clientIdleTimeout {
+			continue
+		}
+
+		delete(me.clients, ip)
+	}
+}
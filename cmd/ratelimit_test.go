@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pomdtr/smallweb/app"
+	"github.com/pomdtr/smallweb/worker"
+)
+
+func newTestApp(config app.RateLimit) app.App {
+	return app.App{Name: "example", Config: app.AppConfig{RateLimit: config}}
+}
+
+func acquire(ctx context.Context, limiter *rateLimiter, a app.App) (func(), int) {
+	r := httptest.NewRequest(http.MethodGet, "https://example.localhost/", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	release, ok := limiter.Acquire(w, r, a)
+	if !ok {
+		return nil, w.Code
+	}
+
+	return release, w.Code
+}
+
+func TestRateLimiterRequestsPerSecond(t *testing.T) {
+	limiter := &rateLimiter{apps: make(map[string]*appLimiter)}
+	a := newTestApp(app.RateLimit{RequestsPerSecond: 1, Burst: 2})
+
+	for i := 0; i < 2; i++ {
+		release, code := acquire(context.Background(), limiter, a)
+		if release == nil {
+			t.Fatalf("request %d: got status %d", i, code)
+		}
+		release()
+	}
+
+	if _, code := acquire(context.Background(), limiter, a); code != http.StatusTooManyRequests {
+		t.Errorf("got status %d, want %d", code, http.StatusTooManyRequests)
+	}
+
+	cron := worker.WithIdentity(context.Background(), worker.Identity{Method: worker.AuthMethodCron})
+	if release, code := acquire(cron, limiter, a); release == nil {
+		t.Errorf("cron requests must not be limited, got status %d", code)
+	}
+}
+
+func TestRateLimiterConcurrency(t *testing.T) {
+	limiter := &rateLimiter{apps: make(map[string]*appLimiter)}
+	a := newTestApp(app.RateLimit{MaxConcurrentRequests: 1, QueueSize: 1})
+
+	release, _ := acquire(context.Background(), limiter, a)
+	if release == nil {
+		t.Fatal("expected the first request to be served")
+	}
+
+	acquired := make(chan func())
+	go func() {
+		release, _ := acquire(context.Background(), limiter, a)
+		acquired <- release
+	}()
+
+	waitQueued(t, limiter, a, 1)
+	if _, code := acquire(context.Background(), limiter, a); code != http.StatusTooManyRequests {
+		t.Errorf("full queue: got status %d, want %d", code, http.StatusTooManyRequests)
+	}
+
+	release()
+	queuedRelease := <-acquired
+	if queuedRelease == nil {
+		t.Fatal("expected the queued request to be served")
+	}
+
+	t.Run("cancelled while queued", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		codes := make(chan int)
+		go func() {
+			_, code := acquire(ctx, limiter, a)
+			codes <- code
+		}()
+
+		waitQueued(t, limiter, a, 1)
+		cancel()
+		if code := <-codes; code != http.StatusServiceUnavailable {
+			t.Errorf("got status %d, want %d", code, http.StatusServiceUnavailable)
+		}
+	})
+
+	t.Run("in-flight requests survive config changes", func(t *testing.T) {
+		a := newTestApp(app.RateLimit{MaxConcurrentRequests: 1, QueueSize: -1})
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		if release, code := acquire(ctx, limiter, a); release != nil || code != http.StatusTooManyRequests {
+			t.Errorf("got status %d, want %d", code, http.StatusTooManyRequests)
+		}
+
+		queuedRelease()
+		release, code := acquire(context.Background(), limiter, a)
+		if release == nil {
+			t.Fatalf("got status %d, want a slot", code)
+		}
+		release()
+	})
+}
+
+func waitQueued(t *testing.T, limiter *rateLimiter, a app.App, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		concurrency := limiter.appLimiter(a).concurrency
+		concurrency.mu.Lock()
+		queued := concurrency.queued
+		concurrency.mu.Unlock()
+		if queued == n {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("expected %d queued requests", n)
+}
+
+func TestRateLimiterRemove(t *testing.T) {
+	limiter := &rateLimiter{apps: make(map[string]*appLimiter)}
+	a := newTestApp(app.RateLimit{RequestsPerSecond: 1, Burst: 1})
+
+	release, _ := acquire(context.Background(), limiter, a)
+	if release == nil {
+		t.Fatal("expected the first request to be served")
+	}
+
+	limiter.Remove(a.Name)
+	if len(limiter.apps) != 0 {
+		t.Errorf("got %d app limiters, want the removed app to be dropped", len(limiter.apps))
+	}
+
+	// releasing a request of a removed app must not panic
+	release()
+
+	// an app created again with the same name starts with a fresh limiter
+	if release, code := acquire(context.Background(), limiter, a); release == nil {
+		t.Errorf("got status %d, want the request to be served", code)
+	}
+}
@@ -77,14 +77,29 @@ func NewCmdRoot(version string, changelog string) *cobra.Command {
 	}
 
 	defaultProvider := confmap.Provider(map[string]interface{}{
-		"host":   "127.0.0.1",
-		"dir":    "~/smallweb",
-		"editor": findEditor(),
-		"shell":  findShell(),
-		"domain": "localhost",
+		"host":        "127.0.0.1",
+		"dir":         "~/smallweb",
+		"editor":      findEditor(),
+		"shell":       findShell(),
+		"domain":      "localhost",
+		"idleTimeout": "5m",
 		"env": map[string]string{
 			"DENO_TLS_CA_STORE": "system",
 		},
+		"deny": map[string]any{
+			"env": []string{"SMALLWEB_*"},
+		},
+		"authLimits": map[string]any{
+			"maxFailures":    5,
+			"window":         "10m",
+			"banDuration":    "1m",
+			"maxBanDuration": "24h",
+		},
+		"timeouts": map[string]any{
+			"header":  "30s",
+			"request": "5m",
+			"idle":    "1m",
+		},
 	}, "")
 
 	envProvider := env.Provider("SMALLWEB_", ".", func(s string) string {
@@ -138,7 +153,7 @@ func NewCmdRoot(version string, changelog string) *cobra.Command {
 	cmd.AddCommand(NewCmdRun())
 	cmd.AddCommand(NewCmdList())
 	cmd.AddCommand(NewCmdDocs())
-	cmd.AddCommand(NewCmdCron())
+	cmd.AddCommand(NewCmdCron(db))
 	cmd.AddCommand(NewCmdVersion())
 	cmd.AddCommand(NewCmdCreate())
 	cmd.AddCommand(NewCmdToken(db))
@@ -147,6 +162,12 @@ func NewCmdRoot(version string, changelog string) *cobra.Command {
 	cmd.AddCommand(NewCmdOpen())
 	cmd.AddCommand(NewCmdService())
 	cmd.AddCommand(NewCmdConfig())
+	cmd.AddCommand(NewCmdCert())
+	cmd.AddCommand(NewCmdDB(db))
+	cmd.AddCommand(NewCmdSession(db))
+	cmd.AddCommand(NewCmdBan(db))
+	cmd.AddCommand(NewCmdOOM(db))
+	cmd.AddCommand(NewCmdLogs())
 
 	cmd.AddCommand(&cobra.Command{
 		Use:   "changelog",
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
@@ -48,7 +49,11 @@ func NewCmdRun() *cobra.Command {
 				cmd.Stderr = os.Stderr
 				return cmd.Run()
 			default:
-				worker := worker.NewWorker(app, k.StringMap("env"))
+				worker, err := newWorker(app)
+				if err != nil {
+					return fmt.Errorf("failed to create worker: %w", err)
+				}
+
 				command, err := worker.Command(args[1:]...)
 				if err != nil {
 					return fmt.Errorf("failed to create command: %w", err)
@@ -58,10 +63,70 @@ func NewCmdRun() *cobra.Command {
 				command.Stdout = os.Stdout
 				command.Stderr = os.Stderr
 
-				return command.Run()
+				if err := worker.Start(command); err != nil {
+					return fmt.Errorf("failed to start command: %w", err)
+				}
+
+				return command.Wait()
 			}
 		},
 	}
 
 	return cmd
 }
+
+// newWorker creates a worker for the app, sandboxed according to the global config.
+func newWorker(a app.App) (*worker.Worker, error) {
+	var permissions app.Permissions
+	if err := unmarshalConfig("permissions", &permissions); err != nil {
+		return nil, err
+	}
+
+	denials, err := globalDenials()
+	if err != nil {
+		return nil, err
+	}
+
+	var timeouts app.Timeouts
+	if err := unmarshalConfig("timeouts", &timeouts); err != nil {
+		return nil, err
+	}
+
+	wk := worker.NewWorker(a, k.StringMap("env"))
+	wk.MaxPermissions = permissions
+	wk.Denials = denials
+	wk.Timeouts = a.Config.Timeouts.Merge(timeouts)
+	return wk, nil
+}
+
+func globalDenials() (app.Denials, error) {
+	var denials app.Denials
+	if err := unmarshalConfig("deny", &denials); err != nil {
+		return app.Denials{}, err
+	}
+
+	if err := denials.Validate(); err != nil {
+		return app.Denials{}, fmt.Errorf("invalid deny in global config: %w", err)
+	}
+
+	return denials, nil
+}
+
+// unmarshalConfig decodes a key of the global config using its json decoder,
+// as some fields (like permissions) accept several types.
+func unmarshalConfig(key string, v any) error {
+	if !k.Exists(key) {
+		return nil
+	}
+
+	b, err := json.Marshal(k.Get(key))
+	if err != nil {
+		return fmt.Errorf("invalid %s in global config: %w", key, err)
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("invalid %s in global config: %w", key, err)
+	}
+
+	return nil
+}
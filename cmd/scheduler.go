@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pomdtr/smallweb/app"
+	"github.com/pomdtr/smallweb/database"
+	"github.com/pomdtr/smallweb/logs"
+	"github.com/robfig/cron/v3"
+)
+
+// defaultCatchupLimit is the maximum number of missed runs of a job using
+// the "all" catch-up policy.
+const defaultCatchupLimit = 10
+
+// maxMissedRuns bounds the number of missed fire times kept for a job, when
+// smallweb was not running for a long time. Only the most recent ones are
+// kept.
+const maxMissedRuns = 10000
+
+// cronScheduler fires the cron jobs of the apps. The last attempted and the
+// last successful fire times of each job are persisted, so that the runs
+// missed while smallweb was not running (or while the machine was asleep) can
+// be caught up.
+type cronScheduler struct {
+	db       *sql.DB
+	logStore *logs.Store
+	handler  http.Handler
+	apps     func() []app.App
+
+	// ticks are serialized, so that a job is not fired twice
+	mu sync.Mutex
+	// started is set after the first tick
+	started bool
+}
+
+// cronFire is a run of a job, for one of its fire times.
+type cronFire struct {
+	Source  string
+	FiredAt time.Time
+}
+
+// Tick fires the jobs due since their last fire time. It is called every
+// minute, and on startup.
+func (me *cronScheduler) Tick(ctx context.Context, now time.Time) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	for _, a := range me.apps() {
+		for _, job := range a.Config.Crons {
+			if err := me.fire(ctx, a, job, now); err != nil {
+				log.Printf("failed to schedule cron job %s: %v", cronJobID(a, job), err)
+			}
+		}
+	}
+
+	me.started = true
+}
+
+func (me *cronScheduler) fire(ctx context.Context, a app.App, job app.CronJob, now time.Time) error {
+	schedule, err := parseCronSchedule(job)
+	if err != nil {
+		return err
+	}
+
+	jobID := cronJobID(a, job)
+	current := now.Truncate(time.Minute)
+	state, err := database.GetCronJobState(me.db, jobID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// new jobs have no missed runs
+		state.LastFiredAt = current.Add(-time.Second)
+		state.LastSucceededAt = &state.LastFiredAt
+	} else if err != nil {
+		return fmt.Errorf("failed to get last fire time: %w", err)
+	}
+
+	since := catchupSince(state, !me.started)
+	onTime, missed := dueCronRuns(schedule, since, current)
+	if !onTime && len(missed) == 0 {
+		return nil
+	}
+
+	latest := current
+	if !onTime {
+		latest = missed[len(missed)-1]
+	}
+
+	if latest.After(state.LastFiredAt) {
+		if err := database.SetCronLastFire(me.db, jobID, latest); err != nil {
+			return fmt.Errorf("failed to set last fire time: %w", err)
+		}
+	}
+
+	if len(missed) > 0 {
+		log.Printf("cron job %s missed %d runs since %s", jobID, len(missed), since.Format(time.RFC3339))
+	}
+
+	fires, err := catchupFires(job, onTime, missed, current)
+	if err != nil {
+		return err
+	}
+
+	if len(fires) == 0 {
+		return nil
+	}
+
+	// jobs run concurrently, so that a slow job does not delay the others
+	go func() {
+		for _, fire := range fires {
+			run, err := runCronJob(ctx, me.db, me.logStore, me.handler, a, job, fire.Source, nil, nil)
+			if err != nil {
+				log.Println(err)
+			} else if run != nil && run.Status == database.CronRunSuccess {
+				if err := me.succeeded(jobID, fire.FiredAt); err != nil {
+					log.Printf("failed to set last success time of cron job %s: %v", jobID, err)
+				}
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// succeeded records the fire time of a successful run, unless a more recent
+// one already succeeded.
+func (me *cronScheduler) succeeded(jobID string, firedAt time.Time) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	state, err := database.GetCronJobState(me.db, jobID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if state.LastSucceededAt != nil && !firedAt.After(*state.LastSucceededAt) {
+		return nil
+	}
+
+	return database.SetCronLastSuccess(me.db, jobID, firedAt)
+}
+
+// catchupSince returns the time after which the fire times of the job are
+// due. On startup, the fire times attempted by a previous process but which
+// did not succeed (because the run failed, or smallweb was stopped during the
+// run) are due again.
+func catchupSince(state database.CronJobState, startup bool) time.Time {
+	if !startup {
+		return state.LastFiredAt
+	}
+
+	if state.LastSucceededAt == nil {
+		return state.LastFiredAt.Add(-time.Second)
+	}
+
+	if state.LastSucceededAt.Before(state.LastFiredAt) {
+		return *state.LastSucceededAt
+	}
+
+	return state.LastFiredAt
+}
+
+// catchupFires returns the runs of the job, according to its catch-up policy
+// for the missed fire times, followed by the run of the current minute if the
+// job is on time.
+func catchupFires(job app.CronJob, onTime bool, missed []time.Time, current time.Time) ([]cronFire, error) {
+	var fires []cronFire
+	switch job.Catchup {
+	case "", app.CatchupNone:
+	case app.CatchupOnce:
+		if len(missed) > 0 && !onTime {
+			fires = append(fires, cronFire{Source: database.CronSourceCatchup, FiredAt: missed[len(missed)-1]})
+		}
+	case app.CatchupAll:
+		limit := job.CatchupLimit
+		if limit <= 0 {
+			limit = defaultCatchupLimit
+		}
+
+		for _, firedAt := range missed[max(len(missed)-limit, 0):] {
+			fires = append(fires, cronFire{Source: database.CronSourceCatchup, FiredAt: firedAt})
+		}
+	default:
+		return nil, fmt.Errorf("invalid catch-up policy: %s", job.Catchup)
+	}
+
+	if onTime {
+		fires = append(fires, cronFire{Source: database.CronSourceSchedule, FiredAt: current})
+	}
+
+	return fires, nil
+}
+
+// dueCronRuns returns whether the schedule fires at the current minute, and
+// the most recent fire times missed since the given time, oldest first.
+func dueCronRuns(schedule cron.Schedule, since time.Time, current time.Time) (onTime bool, missed []time.Time) {
+	for next := schedule.Next(since); !next.IsZero() && !next.After(current); next = schedule.Next(next) {
+		if next.Equal(current) {
+			onTime = true
+			break
+		}
+
+		missed = append(missed, next)
+		if len(missed) == 2*maxMissedRuns {
+			missed = append(missed[:0], missed[maxMissedRuns:]...)
+		}
+	}
+
+	if len(missed) > maxMissedRuns {
+		missed = missed[len(missed)-maxMissedRuns:]
+	}
+
+	return onTime, missed
+}
@@ -0,0 +1,275 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pomdtr/smallweb/app"
+	"github.com/pomdtr/smallweb/database"
+)
+
+func TestDueCronRuns(t *testing.T) {
+	daily, err := parseCronSchedule(app.CronJob{Name: "daily", Schedule: "0 9 * * *", Timezone: "UTC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	minutely, err := parseCronSchedule(app.CronJob{Name: "minutely", Schedule: "* * * * *", Timezone: "UTC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := time.Date(2024, 5, 10, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		since      time.Time
+		current    time.Time
+		wantOnTime bool
+		wantMissed int
+		wantLatest time.Time
+	}{
+		{
+			name:       "on time",
+			since:      current.Add(-time.Second),
+			current:    current,
+			wantOnTime: true,
+		},
+		{
+			name:    "not due",
+			since:   current,
+			current: current.Add(time.Hour),
+		},
+		{
+			name:       "missed runs before an on time one",
+			since:      current.Add(-72 * time.Hour),
+			current:    current,
+			wantOnTime: true,
+			wantMissed: 2,
+			wantLatest: current.Add(-24 * time.Hour),
+		},
+		{
+			name:       "missed runs only",
+			since:      current.Add(-72 * time.Hour),
+			current:    current.Add(time.Hour),
+			wantMissed: 3,
+			wantLatest: current,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			onTime, missed := dueCronRuns(daily, tt.since, tt.current)
+			if onTime != tt.wantOnTime {
+				t.Errorf("onTime = %v, want %v", onTime, tt.wantOnTime)
+			}
+
+			if len(missed) != tt.wantMissed {
+				t.Fatalf("missed %d runs, want %d", len(missed), tt.wantMissed)
+			}
+
+			if len(missed) > 0 && !missed[len(missed)-1].Equal(tt.wantLatest) {
+				t.Errorf("latest missed run = %s, want %s", missed[len(missed)-1], tt.wantLatest)
+			}
+		})
+	}
+
+	t.Run("only the most recent runs are kept", func(t *testing.T) {
+		onTime, missed := dueCronRuns(minutely, current.Add(-30*24*time.Hour), current)
+		if !onTime {
+			t.Error("expected the job to be on time")
+		}
+
+		if len(missed) != maxMissedRuns {
+			t.Fatalf("missed %d runs, want %d", len(missed), maxMissedRuns)
+		}
+
+		if first := current.Add(-maxMissedRuns * time.Minute); !missed[0].Equal(first) {
+			t.Errorf("first missed run = %s, want %s", missed[0], first)
+		}
+
+		if last := current.Add(-time.Minute); !missed[len(missed)-1].Equal(last) {
+			t.Errorf("last missed run = %s, want %s", missed[len(missed)-1], last)
+		}
+	})
+}
+
+func TestCatchupFires(t *testing.T) {
+	current := time.Date(2024, 5, 10, 9, 0, 0, 0, time.UTC)
+	var missed []time.Time
+	for i := 15; i > 0; i-- {
+		missed = append(missed, current.Add(-time.Duration(i)*time.Hour))
+	}
+
+	tests := []struct {
+		name        string
+		job         app.CronJob
+		onTime      bool
+		missed      []time.Time
+		wantCatchup []time.Time
+		wantOnTime  bool
+	}{
+		{
+			name:   "default policy ignores missed runs",
+			missed: missed,
+		},
+		{
+			name:       "none policy ignores missed runs",
+			job:        app.CronJob{Catchup: app.CatchupNone},
+			onTime:     true,
+			missed:     missed,
+			wantOnTime: true,
+		},
+		{
+			name:        "once policy runs the latest missed run",
+			job:         app.CronJob{Catchup: app.CatchupOnce},
+			missed:      missed,
+			wantCatchup: missed[14:],
+		},
+		{
+			name:       "once policy skips catch up when on time",
+			job:        app.CronJob{Catchup: app.CatchupOnce},
+			onTime:     true,
+			missed:     missed,
+			wantOnTime: true,
+		},
+		{
+			name: "once policy without missed runs",
+			job:  app.CronJob{Catchup: app.CatchupOnce},
+		},
+		{
+			name:        "all policy is limited to 10 runs by default",
+			job:         app.CronJob{Catchup: app.CatchupAll},
+			onTime:      true,
+			missed:      missed,
+			wantCatchup: missed[5:],
+			wantOnTime:  true,
+		},
+		{
+			name:        "all policy uses the catch-up limit",
+			job:         app.CronJob{Catchup: app.CatchupAll, CatchupLimit: 2},
+			missed:      missed,
+			wantCatchup: missed[13:],
+		},
+		{
+			name:        "all policy with less missed runs than the limit",
+			job:         app.CronJob{Catchup: app.CatchupAll, CatchupLimit: 20},
+			missed:      missed[:3],
+			wantCatchup: missed[:3],
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fires, err := catchupFires(tt.job, tt.onTime, tt.missed, current)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var want []cronFire
+			for _, firedAt := range tt.wantCatchup {
+				want = append(want, cronFire{Source: database.CronSourceCatchup, FiredAt: firedAt})
+			}
+			if tt.wantOnTime {
+				want = append(want, cronFire{Source: database.CronSourceSchedule, FiredAt: current})
+			}
+
+			if len(fires) != len(want) {
+				t.Fatalf("got %d runs, want %d", len(fires), len(want))
+			}
+
+			for i := range want {
+				if fires[i].Source != want[i].Source || !fires[i].FiredAt.Equal(want[i].FiredAt) {
+					t.Errorf("run %d = %v, want %v", i, fires[i], want[i])
+				}
+			}
+		})
+	}
+
+	if _, err := catchupFires(app.CronJob{Catchup: "sometimes"}, false, missed, current); err == nil {
+		t.Error("expected an error for an invalid policy")
+	}
+}
+
+func TestCatchupSince(t *testing.T) {
+	lastFiredAt := time.Date(2024, 5, 10, 9, 0, 0, 0, time.UTC)
+	lastSucceededAt := lastFiredAt.Add(-24 * time.Hour)
+
+	tests := []struct {
+		name    string
+		state   database.CronJobState
+		startup bool
+		want    time.Time
+	}{
+		{
+			name:  "last attempt while running",
+			state: database.CronJobState{LastFiredAt: lastFiredAt, LastSucceededAt: &lastSucceededAt},
+			want:  lastFiredAt,
+		},
+		{
+			name:    "last success on startup",
+			state:   database.CronJobState{LastFiredAt: lastFiredAt, LastSucceededAt: &lastSucceededAt},
+			startup: true,
+			want:    lastSucceededAt,
+		},
+		{
+			name:    "last attempt on startup, if it succeeded",
+			state:   database.CronJobState{LastFiredAt: lastFiredAt, LastSucceededAt: &lastFiredAt},
+			startup: true,
+			want:    lastFiredAt,
+		},
+		{
+			name:    "last attempt is due again on startup, if no run succeeded",
+			state:   database.CronJobState{LastFiredAt: lastFiredAt},
+			startup: true,
+			want:    lastFiredAt.Add(-time.Second),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := catchupSince(tt.state, tt.startup); !got.Equal(tt.want) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCronSchedulerSucceeded(t *testing.T) {
+	db := openTestDB(t)
+	firedAt := time.Date(2024, 5, 10, 9, 0, 0, 0, time.UTC)
+	if err := database.SetCronLastFire(db, "app:job", firedAt); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := database.GetCronJobState(db, "app:job")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.LastSucceededAt != nil {
+		t.Fatalf("attempted runs must not be recorded as succeeded")
+	}
+
+	scheduler := &cronScheduler{db: db}
+	if err := scheduler.succeeded("app:job", firedAt); err != nil {
+		t.Fatal(err)
+	}
+
+	// runs of older fire times completing later must not move the time back
+	if err := scheduler.succeeded("app:job", firedAt.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err = database.GetCronJobState(db, "app:job")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.LastSucceededAt == nil || !state.LastSucceededAt.Equal(firedAt) {
+		t.Fatalf("last success = %v, want %s", state.LastSucceededAt, firedAt)
+	}
+
+	if !state.LastFiredAt.Equal(firedAt) {
+		t.Fatalf("last fire = %s, want %s", state.LastFiredAt, firedAt)
+	}
+}
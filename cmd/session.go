@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/cli/go-gh/v2/pkg/tableprinter"
+	"github.com/mattn/go-isatty"
+	"github.com/pomdtr/smallweb/database"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+func NewCmdSession(db *sql.DB) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "session",
+		Short:   "Manage user sessions",
+		GroupID: CoreGroupID,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return migrateDB(db)
+		},
+	}
+
+	cmd.AddCommand(NewCmdSessionList(db))
+	cmd.AddCommand(NewCmdSessionRevoke(db))
+	cmd.AddCommand(NewCmdSessionRevokeAll(db))
+	return cmd
+}
+
+func NewCmdSessionList(db *sql.DB) *cobra.Command {
+	var flags struct {
+		email  string
+		domain string
+		json   bool
+	}
+
+	cmd := &cobra.Command{
+		Use:     "list",
+		Short:   "List active sessions",
+		Aliases: []string{"ls"},
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sessions, err := database.ListSessions(db, database.SessionFilter{
+				Email:  flags.email,
+				Domain: flags.domain,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to list sessions: %w", err)
+			}
+
+			sort.Slice(sessions, func(i, j int) bool {
+				return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+			})
+
+			if flags.json {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetEscapeHTML(false)
+
+				if isatty.IsTerminal(os.Stdout.Fd()) {
+					encoder.SetIndent("", "  ")
+				}
+
+				if err := encoder.Encode(sessions); err != nil {
+					return fmt.Errorf("failed to encode sessions: %w", err)
+				}
+
+				return nil
+			}
+
+			if len(sessions) == 0 {
+				fmt.Println("No sessions found")
+				return nil
+			}
+
+			var printer tableprinter.TablePrinter
+			if isatty.IsTerminal(os.Stdout.Fd()) {
+				width, _, err := term.GetSize(int(os.Stdout.Fd()))
+				if err != nil {
+					return fmt.Errorf("failed to get terminal size: %w", err)
+				}
+
+				printer = tableprinter.New(os.Stdout, true, width)
+			} else {
+				printer = tableprinter.New(os.Stdout, false, 0)
+			}
+
+			printer.AddHeader([]string{"ID", "Email", "Domain", "Creation Time", "Expiration Time"})
+			for _, session := range sessions {
+				printer.AddField(session.ID)
+				printer.AddField(session.Email)
+				printer.AddField(session.Domain)
+				printer.AddField(session.CreatedAt.Format("2006-01-02 15:04:05"))
+				expiresAt := session.ExpiresAt.Format("2006-01-02 15:04:05")
+				if time.Now().After(session.ExpiresAt) {
+					expiresAt += " (expired)"
+				}
+				printer.AddField(expiresAt)
+				printer.EndRow()
+			}
+
+			return printer.Render()
+		},
+	}
+
+	cmd.Flags().StringVar(&flags.email, "email", "", "filter by email")
+	cmd.Flags().StringVar(&flags.domain, "domain", "", "filter by domain")
+	cmd.Flags().BoolVarP(&flags.json, "json", "j", false, "output as JSON")
+	return cmd
+}
+
+func NewCmdSessionRevoke(db *sql.DB) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "revoke <id>...",
+		Short:   "Revoke sessions",
+		Aliases: []string{"rm", "remove"},
+		Args:    cobra.MinimumNArgs(1),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			sessions, err := database.ListSessions(db, database.SessionFilter{})
+			if err != nil {
+				return nil, cobra.ShellCompDirectiveError
+			}
+
+			var completions []string
+			for _, session := range sessions {
+				completions = append(completions, fmt.Sprintf("%s\t%s on %s", session.ID, session.Email, session.Domain))
+			}
+
+			return completions, cobra.ShellCompDirectiveNoFileComp
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			for _, arg := range args {
+				if _, err := database.GetSession(db, arg); err != nil {
+					return fmt.Errorf("session %s not found", arg)
+				}
+
+				if err := database.DeleteSession(db, arg); err != nil {
+					return fmt.Errorf("failed to delete session: %w", err)
+				}
+
+				cmd.Printf("Session %s revoked\n", arg)
+			}
+
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+func NewCmdSessionRevokeAll(db *sql.DB) *cobra.Command {
+	var flags struct {
+		email  string
+		domain string
+	}
+
+	cmd := &cobra.Command{
+		Use:   "revoke-all",
+		Short: "Revoke all sessions, optionally filtered by email or domain",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			count, err := database.DeleteSessions(db, database.SessionFilter{
+				Email:  flags.email,
+				Domain: flags.domain,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to delete sessions: %w", err)
+			}
+
+			cmd.Printf("%d sessions revoked\n", count)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&flags.email, "email", "", "only revoke the sessions of this email")
+	cmd.Flags().StringVar(&flags.domain, "domain", "", "only revoke the sessions of this domain")
+	return cmd
+}
+
+// cleanSessions periodically deletes the expired sessions.
+func cleanSessions(ctx context.Context, db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		count, err := database.DeleteExpiredSessions(db, time.Now())
+		if err != nil {
+			log.Printf("failed to delete expired sessions: %v", err)
+		} else if count > 0 {
+			log.Printf("deleted %d expired sessions", count)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pomdtr/smallweb/app"
+	"github.com/pomdtr/smallweb/database"
+)
+
+func TestSessionExtension(t *testing.T) {
+	db := openTestDB(t)
+	middleware := &AuthMiddleware{db: db, limiter: newTestAuthLimiter(db)}
+	a := app.App{Name: "blog", Config: app.AppConfig{Private: true, AuthorizedEmails: []string{"pomdtr@example.com"}}}
+	handler := middleware.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), a)
+
+	tests := []struct {
+		name      string
+		expiresIn time.Duration
+		want      int
+		extended  bool
+	}{
+		{name: "fresh session", expiresIn: 13 * 24 * time.Hour, want: http.StatusNoContent},
+		{name: "session near expiry", expiresIn: 2 * 24 * time.Hour, want: http.StatusNoContent, extended: true},
+		{name: "expired session", expiresIn: -time.Minute, want: http.StatusSeeOther},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessionID := strings.ReplaceAll(tt.name, " ", "-")
+			expiresAt := time.Now().Add(tt.expiresIn)
+			if err := database.InsertSession(db, &database.Session{ID: sessionID, Email: "pomdtr@example.com", Domain: "blog.example.com", CreatedAt: time.Now(), ExpiresAt: expiresAt}); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "https://blog.example.com/", nil)
+			r.AddCookie(&http.Cookie{Name: "smallweb-session", Value: sessionID})
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			// the app must be called even when the session is extended
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d", w.Code, tt.want)
+			}
+
+			var cookie *http.Cookie
+			for _, c := range w.Result().Cookies() {
+				if c.Name == "smallweb-session" {
+					cookie = c
+				}
+			}
+
+			session, err := database.GetSession(db, sessionID)
+			if tt.expiresIn < 0 {
+				if !errors.Is(err, sql.ErrNoRows) {
+					t.Errorf("expired session was not deleted: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !tt.extended {
+				if cookie != nil || !session.ExpiresAt.Equal(expiresAt) {
+					t.Errorf("session was extended to %v", session.ExpiresAt)
+				}
+				return
+			}
+
+			if time.Until(session.ExpiresAt) < 13*24*time.Hour {
+				t.Errorf("session expires at %v, want it to be extended", session.ExpiresAt)
+			}
+
+			if cookie == nil || cookie.Value != sessionID || cookie.Expires.Before(time.Now().Add(13*24*time.Hour)) {
+				t.Errorf("got cookie %v, want it to be refreshed", cookie)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/adrg/xdg"
+	"github.com/pomdtr/smallweb/app"
+	"github.com/pomdtr/smallweb/watcher"
+	"github.com/pomdtr/smallweb/worker"
+)
+
+const ticketTTL = time.Minute
+
+// ssoTicket is issued by the auth domain to a signed in user, and exchanged
+// for a session on the app host.
+type ssoTicket struct {
+	Email     string    `json:"email"`
+	Host      string    `json:"host"`
+	State     string    `json:"state"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// ssoApp is used to protect the auth domain. Every user is allowed to sign
+// in, access control is enforced by the app receiving the ticket.
+var ssoApp = app.App{
+	Name: "auth",
+	Config: app.AppConfig{
+		Private:          true,
+		AuthorizedEmails: []string{"*"},
+	},
+}
+
+// loadSSOKey reads the key used to sign tickets, generating it on first use.
+func loadSSOKey() ([]byte, error) {
+	keyPath := filepath.Join(xdg.DataHome, "smallweb", "sso.key")
+	if key, err := os.ReadFile(keyPath); err == nil {
+		return key, nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate sso key: %w", err)
+	}
+
+	if err := os.WriteFile(keyPath, key, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write sso key: %w", err)
+	}
+
+	return key, nil
+}
+
+func signTicket(key []byte, ticket ssoTicket) (string, error) {
+	payload, err := json.Marshal(ticket)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return fmt.Sprintf("%s.%s", base64.RawURLEncoding.EncodeToString(payload), base64.RawURLEncoding.EncodeToString(mac.Sum(nil))), nil
+}
+
+func verifyTicket(key []byte, value string) (ssoTicket, error) {
+	encodedPayload, encodedSignature, ok := strings.Cut(value, ".")
+	if !ok {
+		return ssoTicket{}, fmt.Errorf("invalid ticket format")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return ssoTicket{}, fmt.Errorf("invalid ticket payload")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return ssoTicket{}, fmt.Errorf("invalid ticket signature")
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return ssoTicket{}, fmt.Errorf("invalid ticket signature")
+	}
+
+	var ticket ssoTicket
+	if err := json.Unmarshal(payload, &ticket); err != nil {
+		return ssoTicket{}, fmt.Errorf("invalid ticket payload")
+	}
+
+	if time.Now().After(ticket.ExpiresAt) {
+		return ssoTicket{}, fmt.Errorf("ticket expired")
+	}
+
+	return ticket, nil
+}
+
+// hostMatchesApp reports whether the host is served by an existing app,
+// either as a subdomain or as a custom domain.
+func hostMatchesApp(appWatcher *watcher.Watcher, domain string, host string) bool {
+	if _, ok := appWatcher.LookupDomain(host); ok {
+		return true
+	}
+
+	if appname, ok := strings.CutSuffix(host, fmt.Sprintf(".%s", domain)); ok {
+		if _, err := appWatcher.GetApp(appname); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ssoHandler serves the auth domain. It is wrapped by the auth middleware, so
+// the user is already signed in when a ticket is requested.
+func (me *AuthMiddleware) ssoHandler(isAppHost func(host string) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_auth/authorize" {
+			http.NotFound(w, r)
+			return
+		}
+
+		identity, ok := worker.IdentityFromContext(r.Context())
+		if !ok || identity.Email == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		query := r.URL.Query()
+		host := query.Get("host")
+		if !isAppHost(host) {
+			log.Printf("sso ticket requested for unknown host: %s", host)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		ticket, err := signTicket(me.ssoKey, ssoTicket{
+			Email:     identity.Email,
+			Host:      host,
+			State:     query.Get("state"),
+			ExpiresAt: time.Now().Add(ticketTTL),
+		})
+		if err != nil {
+			log.Printf("failed to sign sso ticket: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		target := url.URL{
+			Scheme:   "https",
+			Host:     host,
+			Path:     "/_auth/sso",
+			RawQuery: url.Values{"ticket": {ticket}}.Encode(),
+		}
+
+		http.Redirect(w, r, target.String(), http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pomdtr/smallweb/app"
+	"github.com/pomdtr/smallweb/watcher"
+	"github.com/pomdtr/smallweb/worker"
+)
+
+var testSSOKey = []byte("0123456789abcdef0123456789abcdef")
+
+func newTestTicket() ssoTicket {
+	return ssoTicket{
+		Email:     "pomdtr@example.com",
+		Host:      "blog.example.com",
+		State:     "state",
+		ExpiresAt: time.Now().Add(ticketTTL),
+	}
+}
+
+func TestVerifyTicket(t *testing.T) {
+	ticket := newTestTicket()
+	value, err := signTicket(testSSOKey, ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := verifyTicket(testSSOKey, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Email != ticket.Email || got.Host != ticket.Host || got.State != ticket.State || !got.ExpiresAt.Equal(ticket.ExpiresAt) {
+		t.Errorf("got %+v, want %+v", got, ticket)
+	}
+
+	encodedPayload, encodedSignature, _ := strings.Cut(value, ".")
+	forged := ticket
+	forged.Email = "attacker@example.com"
+	forgedPayload, _ := json.Marshal(forged)
+
+	expired := ticket
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	expiredValue, err := signTicket(testSSOKey, expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		key   []byte
+		value string
+	}{
+		{name: "tampered signature", key: testSSOKey, value: encodedPayload + "." + base64.RawURLEncoding.EncodeToString([]byte("signature"))},
+		{name: "tampered payload", key: testSSOKey, value: base64.RawURLEncoding.EncodeToString(forgedPayload) + "." + encodedSignature},
+		{name: "other key", key: []byte("another key"), value: value},
+		{name: "expired", key: testSSOKey, value: expiredValue},
+		{name: "missing signature", key: testSSOKey, value: encodedPayload},
+		{name: "empty", key: testSSOKey, value: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := verifyTicket(tt.key, tt.value); err == nil {
+				t.Error("expected the ticket to be rejected")
+			}
+		})
+	}
+}
+
+func TestSSOHandler(t *testing.T) {
+	middleware := &AuthMiddleware{ssoKey: testSSOKey}
+	handler := middleware.ssoHandler(func(host string) bool {
+		return host == "blog.example.com"
+	})
+
+	authorize := func(host string, identity *worker.Identity) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "https://auth.example.com/_auth/authorize?"+url.Values{"host": {host}, "state": {"state"}}.Encode(), nil)
+		if identity != nil {
+			r = r.WithContext(worker.WithIdentity(r.Context(), *identity))
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	identity := &worker.Identity{Method: worker.AuthMethodSession, Email: "pomdtr@example.com"}
+	w := authorize("blog.example.com", identity)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusSeeOther)
+	}
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if location.Host != "blog.example.com" || location.Path != "/_auth/sso" {
+		t.Errorf("redirected to %s", location)
+	}
+
+	ticket, err := verifyTicket(testSSOKey, location.Query().Get("ticket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ticket.Email != identity.Email || ticket.Host != "blog.example.com" || ticket.State != "state" {
+		t.Errorf("got ticket %+v", ticket)
+	}
+
+	if ttl := time.Until(ticket.ExpiresAt); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("ticket expires in %s, want at most 1m", ttl)
+	}
+
+	if w := authorize("evil.org", identity); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown host: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	if w := authorize("blog.example.com", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestSSOTicketExchange(t *testing.T) {
+	db := openTestDB(t)
+	middleware := &AuthMiddleware{db: db, limiter: newTestAuthLimiter(db), authDomain: "auth.example.com", ssoKey: testSSOKey}
+	a := app.App{Name: "blog", Config: app.AppConfig{Private: true, AuthorizedEmails: []string{"pomdtr@example.com"}}}
+	handler := middleware.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), a)
+
+	exchange := func(host string, state string, ticket ssoTicket) *httptest.ResponseRecorder {
+		t.Helper()
+
+		value, err := signTicket(testSSOKey, ticket)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		store, _ := json.Marshal(map[string]string{"state": state, "redirect": "/"})
+		r := httptest.NewRequest(http.MethodGet, "https://"+host+"/_auth/sso?"+url.Values{"ticket": {value}}.Encode(), nil)
+		r.AddCookie(&http.Cookie{Name: "smallweb-oauth-store", Value: url.QueryEscape(string(store))})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	expired := newTestTicket()
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+
+	tests := []struct {
+		name   string
+		host   string
+		state  string
+		ticket ssoTicket
+		want   int
+	}{
+		{name: "valid ticket", host: "blog.example.com", state: "state", ticket: newTestTicket(), want: http.StatusSeeOther},
+		{name: "replayed to another host", host: "admin.example.com", state: "state", ticket: newTestTicket(), want: http.StatusUnauthorized},
+		{name: "state mismatch", host: "blog.example.com", state: "other", ticket: newTestTicket(), want: http.StatusUnauthorized},
+		{name: "expired ticket", host: "blog.example.com", state: "state", ticket: expired, want: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := exchange(tt.host, tt.state, tt.ticket)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d", w.Code, tt.want)
+			}
+
+			var session bool
+			for _, cookie := range w.Result().Cookies() {
+				if cookie.Name == "smallweb-session" && cookie.Value != "" {
+					session = true
+				}
+			}
+
+			if session != (tt.want == http.StatusSeeOther) {
+				t.Errorf("session cookie set: %v", session)
+			}
+		})
+	}
+}
+
+func TestHostMatchesApp(t *testing.T) {
+	rootDir := t.TempDir()
+	for _, name := range []string{"blog", "custom"} {
+		if err := os.Mkdir(filepath.Join(rootDir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(rootDir, "custom", "CNAME"), []byte("custom.org\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	appWatcher, err := watcher.NewWatcher(rootDir, "example.com", "auth.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer appWatcher.Close()
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "blog.example.com", want: true},
+		{host: "custom.org", want: true},
+		{host: "custom.example.com", want: true},
+		{host: "missing.example.com", want: false},
+		{host: "example.com", want: false},
+		{host: "auth.example.com", want: false},
+		{host: "blog.example.com.evil.org", want: false},
+		{host: "evil.org", want: false},
+		{host: "", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := hostMatchesApp(appWatcher, "example.com", tt.host); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
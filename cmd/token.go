@@ -6,15 +6,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/big"
+	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/adrg/xdg"
 	"github.com/cli/go-gh/v2/pkg/tableprinter"
+	"github.com/gobwas/glob"
 	"github.com/mattn/go-isatty"
+	"github.com/pomdtr/smallweb/app"
 	"github.com/pomdtr/smallweb/database"
+	"github.com/pomdtr/smallweb/utils"
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/term"
@@ -25,17 +31,24 @@ func NewCmdToken(db *sql.DB) *cobra.Command {
 		Use:     "token",
 		Short:   "Manage api tokens",
 		GroupID: CoreGroupID,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return migrateDB(db)
+		},
 	}
 
 	cmd.AddCommand(NewCmdTokenCreate(db))
 	cmd.AddCommand(NewCmdTokenList(db))
 	cmd.AddCommand(NewCmdTokenRemove(db))
+	cmd.AddCommand(NewCmdTokenRotate(db))
 	return cmd
 }
 
 func NewCmdTokenCreate(db *sql.DB) *cobra.Command {
 	var flags struct {
 		description string
+		apps        []string
+		scopes      []string
+		expires     string
 	}
 
 	cmd := &cobra.Command{
@@ -44,6 +57,23 @@ func NewCmdTokenCreate(db *sql.DB) *cobra.Command {
 		Short:   "Create a new token",
 		Args:    cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			for _, scope := range flags.scopes {
+				if !slices.Contains(tokenScopes, scope) {
+					return fmt.Errorf("invalid scope %s, must be one of %s", scope, strings.Join(tokenScopes, ", "))
+				}
+			}
+
+			for _, pattern := range flags.apps {
+				if _, err := glob.Compile(pattern); err != nil {
+					return fmt.Errorf("invalid app pattern %s: %v", pattern, err)
+				}
+			}
+
+			expiresAt, err := parseExpiry(flags.expires)
+			if err != nil {
+				return err
+			}
+
 			value, public, secret, err := generateToken()
 			if err != nil {
 				return fmt.Errorf("failed to generate token: %v", err)
@@ -57,8 +87,11 @@ func NewCmdTokenCreate(db *sql.DB) *cobra.Command {
 			token := database.Token{
 				ID:          public,
 				Description: flags.description,
+				Apps:        flags.apps,
+				Scopes:      flags.scopes,
 				Hash:        hash,
 				CreatedAt:   time.Now(),
+				ExpiresAt:   expiresAt,
 			}
 
 			dataHome := filepath.Join(xdg.DataHome, "smallweb")
@@ -81,6 +114,11 @@ func NewCmdTokenCreate(db *sql.DB) *cobra.Command {
 	}
 
 	cmd.Flags().StringVarP(&flags.description, "description", "d", "", "description of the token")
+	cmd.Flags().StringArrayVar(&flags.apps, "app", nil, "restrict the token to the apps matching the pattern")
+	cmd.Flags().StringArrayVar(&flags.scopes, "scope", nil, fmt.Sprintf("grant access to a service (%s)", strings.Join(tokenScopes, ", ")))
+	cmd.Flags().StringVar(&flags.expires, "expires", "", "expiry of the token, such as 30d, 12h or 2025-12-31")
+	cmd.RegisterFlagCompletionFunc("app", completeApp(utils.ExpandTilde(k.String("dir"))))
+	cmd.RegisterFlagCompletionFunc("scope", cobra.FixedCompletions(tokenScopes, cobra.ShellCompDirectiveNoFileComp))
 
 	return cmd
 }
@@ -133,7 +171,7 @@ func NewCmdTokenList(db *sql.DB) *cobra.Command {
 				printer = tableprinter.New(os.Stdout, false, 0)
 			}
 
-			printer.AddHeader([]string{"ID", "Description", "Creation Time"})
+			printer.AddHeader([]string{"ID", "Description", "Apps", "Scopes", "Creation Time", "Expiration Time", "Last Used", "Last IP"})
 			for _, token := range tokens {
 				printer.AddField(token.ID)
 				description := token.Description
@@ -141,7 +179,29 @@ func NewCmdTokenList(db *sql.DB) *cobra.Command {
 					description = "N/A"
 				}
 				printer.AddField(description)
+				apps := strings.Join(token.Apps, ", ")
+				if apps == "" {
+					apps = "*"
+				}
+				printer.AddField(apps)
+				scopes := strings.Join(token.Scopes, ", ")
+				if scopes == "" {
+					scopes = "N/A"
+				}
+				printer.AddField(scopes)
 				printer.AddField(token.CreatedAt.Format("2006-01-02 15:04:05"))
+				if token.ExpiresAt != nil {
+					printer.AddField(token.ExpiresAt.Format("2006-01-02 15:04:05"))
+				} else {
+					printer.AddField("Never")
+				}
+				if token.LastUsedAt != nil {
+					printer.AddField(token.LastUsedAt.Format("2006-01-02 15:04:05"))
+					printer.AddField(token.LastUsedIP)
+				} else {
+					printer.AddField("Never")
+					printer.AddField("N/A")
+				}
 				printer.EndRow()
 			}
 
@@ -188,6 +248,149 @@ func NewCmdTokenRemove(db *sql.DB) *cobra.Command {
 	return cmd
 }
 
+func NewCmdTokenRotate(db *sql.DB) *cobra.Command {
+	var flags struct {
+		expires string
+	}
+
+	cmd := &cobra.Command{
+		Use:   "rotate <id>",
+		Short: "Issue a new secret for a token",
+		Long:  "Issue a new secret for a token. The previous secret stops working immediately, while the id and scopes of the token are kept.",
+		Args:  cobra.ExactArgs(1),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) > 0 {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+
+			tokens, err := database.ListTokens(db)
+			if err != nil {
+				return nil, cobra.ShellCompDirectiveError
+			}
+
+			var completions []string
+			for _, token := range tokens {
+				completions = append(completions, fmt.Sprintf("%s\t%s", token.ID, token.Description))
+			}
+
+			return completions, cobra.ShellCompDirectiveNoFileComp
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			token, err := database.GetToken(db, args[0])
+			if err != nil {
+				return fmt.Errorf("failed to get token: %v", err)
+			}
+
+			expiresAt := token.ExpiresAt
+			if cmd.Flags().Changed("expires") {
+				if expiresAt, err = parseExpiry(flags.expires); err != nil {
+					return err
+				}
+			}
+
+			secret, err := generateBase62String(secretPartLength)
+			if err != nil {
+				return fmt.Errorf("failed to generate token: %v", err)
+			}
+
+			hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+			if err != nil {
+				return fmt.Errorf("failed to hash secret: %v", err)
+			}
+
+			if err := database.RotateToken(db, token.ID, hash, expiresAt); err != nil {
+				return fmt.Errorf("failed to rotate token: %v", err)
+			}
+
+			value := fmt.Sprintf("%s_%s_%s", tokenPrefix, token.ID, secret)
+			if isatty.IsTerminal(os.Stdout.Fd()) {
+				fmt.Println(value)
+			} else {
+				fmt.Print(value)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&flags.expires, "expires", "", "new expiry of the token, such as 30d, 12h or 2025-12-31 (defaults to the current one)")
+	return cmd
+}
+
+// parseExpiry converts a duration or a date to an expiry date. On top of the
+// units supported by time.ParseDuration, it accepts days (30d). Dates are
+// either RFC 3339 timestamps or days (2025-12-31), which expire at midnight.
+func parseExpiry(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	now := time.Now()
+	var expiresAt time.Time
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		expiresAt = t
+	} else if t, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		expiresAt = t
+	} else if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry: %s", value)
+		}
+
+		expiresAt = now.Add(time.Duration(n) * 24 * time.Hour)
+	} else {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry: %s", value)
+		}
+
+		expiresAt = now.Add(d)
+	}
+
+	if !expiresAt.After(now) {
+		return nil, fmt.Errorf("invalid expiry: %s is in the past", value)
+	}
+
+	return &expiresAt, nil
+}
+
+const (
+	ScopeCli         = "cli"
+	ScopeWebdavRead  = "webdav:read"
+	ScopeWebdavWrite = "webdav:write"
+)
+
+var tokenScopes = []string{ScopeCli, ScopeWebdavRead, ScopeWebdavWrite}
+
+// tokenAllows reports whether the token grants access to the request. Tokens
+// without apps can access every app, but services require a scope.
+func tokenAllows(token database.Token, a app.App, r *http.Request) bool {
+	if len(token.Apps) > 0 && !slices.ContainsFunc(token.Apps, func(pattern string) bool {
+		g, err := glob.Compile(pattern)
+		return err == nil && g.Match(a.Name)
+	}) {
+		return false
+	}
+
+	switch a.Entrypoint() {
+	case "smallweb:cli":
+		return slices.Contains(token.Scopes, ScopeCli)
+	case "smallweb:webdav", "smallweb:editor":
+		if slices.Contains(token.Scopes, ScopeWebdavWrite) {
+			return true
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+			return slices.Contains(token.Scopes, ScopeWebdavRead)
+		default:
+			return false
+		}
+	default:
+		return true
+	}
+}
+
 // Base62 character set
 const base62Charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
 
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pomdtr/smallweb/app"
+	"github.com/pomdtr/smallweb/database"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestTokenAllows(t *testing.T) {
+	blog := app.App{Name: "blog"}
+	admin := app.App{Name: "admin-panel"}
+	cli := app.App{Name: "cli", Config: app.AppConfig{Entrypoint: "smallweb:cli"}}
+	webdav := app.App{Name: "webdav", Config: app.AppConfig{Entrypoint: "smallweb:webdav"}}
+	editor := app.App{Name: "editor", Config: app.AppConfig{Entrypoint: "smallweb:editor"}}
+
+	// tokens created before scopes were introduced are migrated with these
+	legacy := database.Token{Scopes: []string{ScopeCli, ScopeWebdavWrite}}
+	unscoped := database.Token{}
+	cliOnly := database.Token{Scopes: []string{ScopeCli}}
+	readOnly := database.Token{Scopes: []string{ScopeWebdavRead}}
+	readWrite := database.Token{Scopes: []string{ScopeWebdavWrite}}
+	blogOnly := database.Token{Apps: []string{"blog"}, Scopes: []string{ScopeCli, ScopeWebdavWrite}}
+	adminApps := database.Token{Apps: []string{"admin-*"}}
+
+	type testCase struct {
+		name   string
+		token  database.Token
+		app    app.App
+		method string
+		want   bool
+	}
+
+	tests := []testCase{
+		{name: "legacy token, app", token: legacy, app: blog, want: true},
+		{name: "legacy token, cli", token: legacy, app: cli, want: true},
+		{name: "legacy token, webdav write", token: legacy, app: webdav, method: "PUT", want: true},
+		{name: "unscoped token, app", token: unscoped, app: blog, want: true},
+		{name: "unscoped token, cli", token: unscoped, app: cli, want: false},
+		{name: "unscoped token, webdav read", token: unscoped, app: webdav, method: "PROPFIND", want: false},
+		{name: "cli scope, cli", token: cliOnly, app: cli, want: true},
+		{name: "cli scope, webdav", token: cliOnly, app: webdav, want: false},
+		{name: "webdav read scope, cli", token: readOnly, app: cli, want: false},
+		{name: "webdav write scope, editor", token: readWrite, app: editor, method: "PUT", want: true},
+		{name: "webdav write scope, delete", token: readWrite, app: webdav, method: "DELETE", want: true},
+		{name: "app restriction, allowed app", token: blogOnly, app: blog, want: true},
+		{name: "app restriction, other app", token: blogOnly, app: admin, want: false},
+		{name: "app restriction, cli app", token: blogOnly, app: cli, want: false},
+		{name: "app glob, matching app", token: adminApps, app: admin, want: true},
+		{name: "app glob, other app", token: adminApps, app: blog, want: false},
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND"} {
+		tests = append(tests,
+			testCase{name: "webdav read scope, " + method, token: readOnly, app: webdav, method: method, want: true},
+			testCase{name: "webdav read scope on the editor, " + method, token: readOnly, app: editor, method: method, want: true},
+		)
+	}
+
+	for _, method := range []string{http.MethodPut, http.MethodDelete, http.MethodPost, "MKCOL", "MOVE", "COPY", "PROPPATCH", "LOCK", "UNLOCK"} {
+		tests = append(tests, testCase{name: "webdav read scope, " + method, token: readOnly, app: webdav, method: method, want: false})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			r := httptest.NewRequest(method, "https://example.localhost/", nil)
+			if got := tokenAllows(tt.token, tt.app, r); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	nextYear := time.Now().Year() + 1
+	tests := []struct {
+		value string
+		want  time.Duration
+		date  time.Time
+		err   bool
+	}{
+		{value: "", want: 0},
+		{value: "12h", want: 12 * time.Hour},
+		{value: "90m", want: 90 * time.Minute},
+		{value: "30d", want: 30 * 24 * time.Hour},
+		{value: fmt.Sprintf("%d-12-31", nextYear), date: time.Date(nextYear, 12, 31, 0, 0, 0, 0, time.Local)},
+		{value: fmt.Sprintf("%d-06-01T18:00:00Z", nextYear), date: time.Date(nextYear, 6, 1, 18, 0, 0, 0, time.UTC)},
+		{value: "0d", err: true},
+		{value: "-1h", err: true},
+		{value: "2020-01-01", err: true},
+		{value: "2020-01-01T00:00:00Z", err: true},
+		{value: "tomorrow", err: true},
+		{value: "xd", err: true},
+		{value: "1.5d", err: true},
+		{value: "2025-13-01", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			before := time.Now()
+			expiresAt, err := parseExpiry(tt.value)
+			if tt.err {
+				if err == nil {
+					t.Errorf("got %v, want an error", expiresAt)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			switch {
+			case tt.value == "":
+				if expiresAt != nil {
+					t.Errorf("got %v, want no expiry", expiresAt)
+				}
+			case !tt.date.IsZero():
+				if expiresAt == nil || !expiresAt.Equal(tt.date) {
+					t.Errorf("got %v, want %v", expiresAt, tt.date)
+				}
+			default:
+				if expiresAt == nil || expiresAt.Before(before.Add(tt.want)) || expiresAt.After(time.Now().Add(tt.want)) {
+					t.Errorf("got %v, want %s from now", expiresAt, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthenticateTokenExpiry(t *testing.T) {
+	db := openTestDB(t)
+	middleware := &AuthMiddleware{db: db}
+
+	insert := func(expiresAt *time.Time) string {
+		value, public, secret, err := generateToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := database.InsertToken(db, database.Token{ID: public, Hash: hash, CreatedAt: time.Now(), ExpiresAt: expiresAt}); err != nil {
+			t.Fatal(err)
+		}
+
+		return value
+	}
+
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	tests := []struct {
+		name      string
+		expiresAt *time.Time
+		wantErr   bool
+	}{
+		{name: "no expiry", expiresAt: nil},
+		{name: "not expired yet", expiresAt: &future},
+		{name: "expired", expiresAt: &past, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := middleware.authenticateToken(insert(tt.expiresAt))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
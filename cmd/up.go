@@ -3,8 +3,10 @@ package cmd
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
@@ -12,8 +14,10 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	_ "embed"
@@ -28,16 +32,22 @@ import (
 
 	"github.com/pomdtr/smallweb/term"
 	"github.com/pomdtr/smallweb/utils"
+	"github.com/pomdtr/smallweb/watcher"
 	"github.com/pomdtr/smallweb/worker"
 	"github.com/robfig/cron/v3"
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/webdav"
-	"golang.org/x/oauth2"
 )
 
 type AuthMiddleware struct {
-	db *sql.DB
+	db       *sql.DB
+	provider *OIDCProvider
+	limiter  *authLimiter
+	// when set, sessions are issued by the auth domain, and handed out to
+	// apps using tickets signed with the sso key
+	authDomain string
+	ssoKey     []byte
 }
 
 func (me *AuthMiddleware) CreateSession(email string, domain string) (string, error) {
@@ -96,7 +106,43 @@ func (me *AuthMiddleware) ExtendSession(sessionID string, expiresAt time.Time) e
 	return nil
 }
 
-func (me *AuthMiddleware) Wrap(next http.Handler, email string) http.Handler {
+// authenticateToken returns the token matching the value, if its secret is valid.
+func (me *AuthMiddleware) authenticateToken(value string) (database.Token, error) {
+	public, secret, err := parseToken(value)
+	if err != nil {
+		return database.Token{}, err
+	}
+
+	token, err := database.GetToken(me.db, public)
+	if err != nil {
+		return database.Token{}, fmt.Errorf("failed to get token: %w", err)
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(token.Hash), []byte(secret)); err != nil {
+		return database.Token{}, fmt.Errorf("invalid token secret")
+	}
+
+	if token.ExpiresAt != nil && time.Now().After(*token.ExpiresAt) {
+		return database.Token{}, fmt.Errorf("token expired")
+	}
+
+	return token, nil
+}
+
+// touchToken records the last usage of a token. Writes are throttled, as
+// tokens are checked on every request.
+func (me *AuthMiddleware) touchToken(token database.Token, r *http.Request) {
+	ip := clientIP(r)
+	if token.LastUsedAt != nil && time.Since(*token.LastUsedAt) < time.Minute && token.LastUsedIP == ip {
+		return
+	}
+
+	if err := database.TouchToken(me.db, token.ID, ip, time.Now()); err != nil {
+		log.Printf("failed to update token usage: %v", err)
+	}
+}
+
+func (me *AuthMiddleware) Wrap(next http.Handler, a app.App) http.Handler {
 	sessionCookieName := "smallweb-session"
 	oauthCookieName := "smallweb-oauth-store"
 	type oauthStore struct {
@@ -105,75 +151,69 @@ func (me *AuthMiddleware) Wrap(next http.Handler, email string) http.Handler {
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		username, _, ok := r.BasicAuth()
-		if ok {
-			public, secret, err := parseToken(username)
-			if err != nil {
-				w.Header().Add("WWW-Authenticate", `Basic realm="smallweb"`)
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-
-			token, err := database.GetToken(me.db, public)
-			if err != nil {
-				w.Header().Add("WWW-Authenticate", `Basic realm="smallweb"`)
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-
-			if bcrypt.CompareHashAndPassword([]byte(token.Hash), []byte(secret)) != nil {
-				w.Header().Add("WWW-Authenticate", `Basic realm="smallweb"`)
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-
+		// the requests of cron jobs are issued by smallweb itself
+		if identity, ok := worker.IdentityFromContext(r.Context()); ok && identity.Method == worker.AuthMethodCron {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		authorization := r.Header.Get("Authorization")
-		if strings.HasPrefix(authorization, "Bearer ") {
-			public, secret, err := parseToken(strings.TrimPrefix(authorization, "Bearer "))
-			if err != nil {
-				w.Header().Add("WWW-Authenticate", `Bearer realm="smallweb"`)
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		var tokenValue, scheme string
+		if username, _, ok := r.BasicAuth(); ok {
+			tokenValue, scheme = username, "Basic"
+		} else if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+			tokenValue, scheme = strings.TrimPrefix(authorization, "Bearer "), "Bearer"
+		}
+
+		// bans are keyed on the ip only, as anyone knowing the id of a token
+		// could otherwise lock its owner out
+		ipKey := fmt.Sprintf("ip:%s", clientIP(r))
+		if scheme != "" {
+			// checked before comparing the secret, as bcrypt is expensive
+			if retryAfter, banned := me.limiter.Check(ipKey); banned {
+				tooManyRequests(w, retryAfter)
 				return
 			}
 
-			t, err := database.GetToken(me.db, public)
+			// a token id failing too often is throttled, but never banned
+			tokenID, _, _ := parseToken(tokenValue)
+			if tokenID != "" {
+				if retryAfter, ok := me.limiter.Throttle(r.Context(), tokenID); !ok {
+					tooManyRequests(w, retryAfter)
+					return
+				}
+			}
+
+			token, err := me.authenticateToken(tokenValue)
 			if err != nil {
-				w.Header().Add("WWW-Authenticate", `Bearer realm="smallweb"`)
+				me.limiter.Fail(ipKey)
+				if tokenID != "" {
+					me.limiter.FailToken(tokenID)
+				}
+				w.Header().Add("WWW-Authenticate", fmt.Sprintf(`%s realm="smallweb"`, scheme))
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
-			if bcrypt.CompareHashAndPassword([]byte(t.Hash), []byte(secret)) != nil {
-				w.Header().Add("WWW-Authenticate", `Bearer realm="smallweb"`)
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			if !tokenAllows(token, a, r) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
 				return
 			}
 
-			next.ServeHTTP(w, r)
+			me.touchToken(token, r)
+			next.ServeHTTP(w, r.WithContext(worker.WithIdentity(r.Context(), worker.Identity{
+				Method:  worker.AuthMethodToken,
+				TokenID: token.ID,
+			})))
 			return
 		}
 
-		if email == "" {
+		authorizedEmails := authorizedEmails(a)
+		if len(authorizedEmails) == 0 {
 			w.Header().Add("WWW-Authenticate", `Basic realm="smallweb"`)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		oauth2Config := oauth2.Config{
-			ClientID: fmt.Sprintf("https://%s/", r.Host),
-			Endpoint: oauth2.Endpoint{
-				AuthURL:   "https://lastlogin.net/auth",
-				TokenURL:  "https://lastlogin.net/token",
-				AuthStyle: oauth2.AuthStyleInParams,
-			},
-			Scopes:      []string{"email"},
-			RedirectURL: fmt.Sprintf("https://%s/_auth/callback", r.Host),
-		}
-
 		if r.URL.Path == "/_auth/login" {
 			query := r.URL.Query()
 			state, err := generateBase62String(16)
@@ -202,11 +242,37 @@ func (me *AuthMiddleware) Wrap(next http.Handler, email string) http.Handler {
 				Secure:   true,
 			})
 
+			if me.authDomain != "" && r.Host != me.authDomain {
+				target := url.URL{
+					Scheme:   "https",
+					Host:     me.authDomain,
+					Path:     "/_auth/authorize",
+					RawQuery: url.Values{"host": {r.Host}, "state": {state}}.Encode(),
+				}
+
+				http.Redirect(w, r, target.String(), http.StatusSeeOther)
+				return
+			}
+
+			oauth2Config, err := me.provider.Config(r.Context(), r.Host)
+			if err != nil {
+				log.Printf("failed to get oauth2 config: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+
 			url := oauth2Config.AuthCodeURL(state)
 			http.Redirect(w, r, url, http.StatusSeeOther)
 			return
 		}
 
+		if r.URL.Path == "/_auth/callback" || r.URL.Path == "/_auth/sso" {
+			if retryAfter, banned := me.limiter.Check(ipKey); banned {
+				tooManyRequests(w, retryAfter)
+				return
+			}
+		}
+
 		if r.URL.Path == "/_auth/callback" {
 			query := r.URL.Query()
 			oauthCookie, err := r.Cookie(oauthCookieName)
@@ -232,6 +298,7 @@ func (me *AuthMiddleware) Wrap(next http.Handler, email string) http.Handler {
 
 			if query.Get("state") != oauthStore.State {
 				log.Printf("state mismatch: %s != %s", query.Get("state"), oauthStore.State)
+				me.limiter.Fail(ipKey)
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
@@ -243,46 +310,91 @@ func (me *AuthMiddleware) Wrap(next http.Handler, email string) http.Handler {
 				return
 			}
 
-			token, err := oauth2Config.Exchange(r.Context(), code)
+			oauth2Config, err := me.provider.Config(r.Context(), r.Host)
 			if err != nil {
-				log.Printf("failed to exchange code: %v", err)
+				log.Printf("failed to get oauth2 config: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+
+			identity, err := me.provider.Exchange(r.Context(), oauth2Config, code)
+			if err != nil {
+				log.Printf("failed to authenticate user: %v", err)
+				me.limiter.Fail(ipKey)
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
-			req, err := http.NewRequest("GET", "https://lastlogin.net/userinfo", nil)
+			sessionID, err := me.CreateSession(identity, r.Host)
 			if err != nil {
-				log.Printf("failed to create userinfo request: %v", err)
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				log.Printf("failed to create session: %v", err)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			// delete oauth cookie
+			http.SetCookie(w, &http.Cookie{
+				Name:     oauthCookieName,
+				Expires:  time.Now().Add(-1 * time.Hour),
+				Path:     "/",
+				SameSite: http.SameSiteLaxMode,
+				HttpOnly: true,
+				Secure:   true,
+			})
+
+			// set session cookie
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookieName,
+				Value:    sessionID,
+				Expires:  time.Now().Add(14 * 24 * time.Hour),
+				SameSite: http.SameSiteLaxMode,
+				HttpOnly: true,
+				Secure:   true,
+				Path:     "/",
+			})
+
+			http.Redirect(w, r, oauthStore.Redirect, http.StatusSeeOther)
+			return
+		}
+
+		if r.URL.Path == "/_auth/sso" {
+			oauthCookie, err := r.Cookie(oauthCookieName)
+			if err != nil {
+				log.Printf("failed to get oauth cookie: %v", err)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
-			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
 
-			resp, err := http.DefaultClient.Do(req)
+			var oauthStore oauthStore
+			value, err := url.QueryUnescape(oauthCookie.Value)
 			if err != nil {
-				log.Printf("failed to execute userinfo request: %v", err)
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				log.Printf("failed to unescape oauth cookie: %v", err)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
-			defer resp.Body.Close()
 
-			if resp.StatusCode != http.StatusOK {
-				log.Printf("userinfo request failed: %s", resp.Status)
+			if err := json.Unmarshal([]byte(value), &oauthStore); err != nil {
+				log.Printf("failed to unmarshal oauth cookie: %v", err)
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
-			var userinfo struct {
-				Email string `json:"email"`
+			ticket, err := verifyTicket(me.ssoKey, r.URL.Query().Get("ticket"))
+			if err != nil {
+				log.Printf("invalid sso ticket: %v", err)
+				me.limiter.Fail(ipKey)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
 			}
 
-			if err := json.NewDecoder(resp.Body).Decode(&userinfo); err != nil {
-				log.Printf("failed to decode userinfo: %v", err)
+			if ticket.Host != r.Host || ticket.State != oauthStore.State {
+				log.Printf("sso ticket mismatch for %s", r.Host)
+				me.limiter.Fail(ipKey)
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
-			sessionID, err := me.CreateSession(userinfo.Email, r.Host)
+			sessionID, err := me.CreateSession(ticket.Email, r.Host)
 			if err != nil {
 				log.Printf("failed to create session: %v", err)
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -315,17 +427,12 @@ func (me *AuthMiddleware) Wrap(next http.Handler, email string) http.Handler {
 		}
 
 		if r.URL.Path == "/_auth/logout" {
-			cookie, err := r.Cookie(sessionCookieName)
-			if err != nil {
-				log.Printf("failed to get session cookie: %v", err)
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-
-			if err := me.DeleteSession(cookie.Value); err != nil {
-				log.Printf("failed to delete session: %v", err)
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
+			if cookie, err := r.Cookie(sessionCookieName); err == nil {
+				if err := me.DeleteSession(cookie.Value); err != nil {
+					log.Printf("failed to delete session: %v", err)
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
 			}
 
 			http.SetCookie(w, &http.Cookie{
@@ -339,7 +446,24 @@ func (me *AuthMiddleware) Wrap(next http.Handler, email string) http.Handler {
 
 			redirect := r.URL.Query().Get("redirect")
 			if redirect == "" {
-				redirect = fmt.Sprintf("https://%s/", r.Host)
+				redirect = "/"
+			}
+
+			// also sign out from the auth domain, otherwise the user would be
+			// signed in again on the next request
+			if me.authDomain != "" && r.Host != me.authDomain {
+				if strings.HasPrefix(redirect, "/") {
+					redirect = fmt.Sprintf("https://%s%s", r.Host, redirect)
+				}
+
+				target := url.URL{
+					Scheme:   "https",
+					Host:     me.authDomain,
+					Path:     "/_auth/logout",
+					RawQuery: url.Values{"redirect": {redirect}}.Encode(),
+				}
+
+				redirect = target.String()
 			}
 
 			http.Redirect(w, r, redirect, http.StatusSeeOther)
@@ -348,7 +472,7 @@ func (me *AuthMiddleware) Wrap(next http.Handler, email string) http.Handler {
 
 		cookie, err := r.Cookie(sessionCookieName)
 		if err != nil {
-			http.Redirect(w, r, fmt.Sprintf("/_auth/login?redirect=%s", r.URL.Path), http.StatusSeeOther)
+			http.Redirect(w, r, fmt.Sprintf("/_auth/login?redirect=%s", url.QueryEscape(r.URL.RequestURI())), http.StatusSeeOther)
 			return
 		}
 
@@ -362,7 +486,7 @@ func (me *AuthMiddleware) Wrap(next http.Handler, email string) http.Handler {
 				Secure:   true,
 			})
 
-			http.Redirect(w, r, fmt.Sprintf("/_auth/login?redirect=%s", r.URL.Path), http.StatusSeeOther)
+			http.Redirect(w, r, fmt.Sprintf("/_auth/login?redirect=%s", url.QueryEscape(r.URL.RequestURI())), http.StatusSeeOther)
 			return
 		}
 
@@ -380,27 +504,39 @@ func (me *AuthMiddleware) Wrap(next http.Handler, email string) http.Handler {
 				Secure:   true,
 			})
 
-			http.Redirect(w, r, fmt.Sprintf("/_auth/login?redirect=%s", r.URL.Path), http.StatusSeeOther)
+			http.Redirect(w, r, fmt.Sprintf("/_auth/login?redirect=%s", url.QueryEscape(r.URL.RequestURI())), http.StatusSeeOther)
 			return
 		}
 
-		if session.Email != email {
-			log.Printf("email mismatch: %s != %s", session.Email, email)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if !isAuthorized(session.Email, authorizedEmails) {
+			log.Printf("user %s is not authorized to access %s", session.Email, r.Host)
+			serveForbiddenPage(w, r, session.Email)
 			return
 		}
 
 		// if session is near expiration, extend it
 		if time.Now().Add(7 * 24 * time.Hour).After(session.ExpiresAt) {
-			if err := me.ExtendSession(cookie.Value, time.Now().Add(14*24*time.Hour)); err != nil {
+			expiresAt := time.Now().Add(14 * 24 * time.Hour)
+			if err := me.ExtendSession(cookie.Value, expiresAt); err != nil {
 				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 				return
 			}
 
-			return
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookieName,
+				Value:    cookie.Value,
+				Expires:  expiresAt,
+				SameSite: http.SameSiteLaxMode,
+				HttpOnly: true,
+				Secure:   true,
+				Path:     "/",
+			})
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(worker.WithIdentity(r.Context(), worker.Identity{
+			Method: worker.AuthMethodSession,
+			Email:  session.Email,
+		})))
 	})
 }
 
@@ -455,6 +591,10 @@ func NewCmdUp(db *sql.DB) *cobra.Command {
 		Aliases: []string{"serve"},
 		Args:    cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := migrateDB(db); err != nil {
+				return err
+			}
+
 			logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 			rootDir := utils.ExpandTilde(k.String("dir"))
 			domain := k.String("domain")
@@ -463,7 +603,7 @@ func NewCmdUp(db *sql.DB) *cobra.Command {
 			key := k.String("key")
 
 			if port == 0 {
-				if cert != "" || key != "" {
+				if cert != "" || key != "" || k.Exists("acme") {
 					port = 443
 				} else {
 					port = 7777
@@ -492,11 +632,103 @@ func NewCmdUp(db *sql.DB) *cobra.Command {
 				return fmt.Errorf("failed to create docs handler: %w", err)
 			}
 
-			authMiddleware := AuthMiddleware{db}
-			addr := fmt.Sprintf("%s:%d", k.String("host"), port)
-			server := http.Server{
-				Addr: addr,
-				Handler: loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			appWatcher, err := watcher.NewWatcher(rootDir, domain, k.String("authDomain"))
+			if err != nil {
+				return fmt.Errorf("failed to create watcher: %w", err)
+			}
+			defer appWatcher.Close()
+
+			logStore, err := newLogStore()
+			if err != nil {
+				return fmt.Errorf("failed to create log store: %w", err)
+			}
+			defer logStore.Close()
+
+			// checked on startup, instead of failing each time a worker starts
+			if _, err := globalDenials(); err != nil {
+				return err
+			}
+
+			if _, err := trustedProxies(); err != nil {
+				return fmt.Errorf("invalid trustedProxies in global config: %w", err)
+			}
+
+			if err := validateGroups(); err != nil {
+				return fmt.Errorf("invalid groups in global config: %w", err)
+			}
+
+			pool := worker.NewPool(func(a app.App) (*worker.Worker, error) {
+				wk, err := newWorker(a)
+				if err != nil {
+					return nil, err
+				}
+
+				wk.Logs = logStore
+
+				wk.OnOOMKill = func(reason string) {
+					if err := database.InsertOOMKill(db, database.OOMKill{
+						App:       a.Name,
+						Reason:    reason,
+						CreatedAt: time.Now(),
+					}); err != nil {
+						log.Printf("failed to record oom kill: %v", err)
+					}
+				}
+
+				return wk, nil
+			}, k.Duration("idleTimeout"))
+			defer pool.Close()
+
+			appWatcher.Subscribe(func(event watcher.Event) {
+				pool.Invalidate(event.App)
+			})
+			go appWatcher.Start()
+
+			provider, err := NewOIDCProvider()
+			if err != nil {
+				return fmt.Errorf("failed to create oidc provider: %w", err)
+			}
+
+			limiter, err := newAuthLimiter(db)
+			if err != nil {
+				return fmt.Errorf("failed to create auth limiter: %w", err)
+			}
+
+			rateLimiter, err := newRateLimiter()
+			if err != nil {
+				return fmt.Errorf("failed to create rate limiter: %w", err)
+			}
+
+			appWatcher.Subscribe(func(event watcher.Event) {
+				if event.Removed {
+					rateLimiter.Remove(event.App)
+				}
+			})
+
+			authMiddleware := AuthMiddleware{db: db, provider: provider, limiter: limiter, authDomain: k.String("authDomain")}
+			if authMiddleware.authDomain != "" {
+				key, err := loadSSOKey()
+				if err != nil {
+					return err
+				}
+
+				authMiddleware.ssoKey = key
+			}
+
+			ssoHandler := authMiddleware.Wrap(authMiddleware.ssoHandler(func(host string) bool {
+				return hostMatchesApp(appWatcher, domain, host)
+			}), ssoApp)
+
+			// the requests of cron jobs go through the same routing as the
+			// ones received by the server
+			router := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if authMiddleware.authDomain != "" && r.Host == authMiddleware.authDomain {
+					ssoHandler.ServeHTTP(w, r)
+					return
+				}
+
+				a, ok := appWatcher.LookupDomain(r.Host)
+				if !ok {
 					if r.Host == domain {
 						target := r.URL
 						target.Scheme = "https"
@@ -505,121 +737,136 @@ func NewCmdUp(db *sql.DB) *cobra.Command {
 						return
 					}
 
-					appname := strings.TrimSuffix(r.Host, fmt.Sprintf(".%s", domain))
-					a, err := app.LoadApp(filepath.Join(rootDir, appname), k.String("domain"))
+					appname, ok := strings.CutSuffix(r.Host, fmt.Sprintf(".%s", domain))
+					if !ok {
+						w.WriteHeader(http.StatusNotFound)
+						return
+					}
+
+					app, err := appWatcher.GetApp(appname)
 					if err != nil {
 						w.WriteHeader(http.StatusNotFound)
 						return
 					}
 
-					var handler http.Handler
-					switch a.Entrypoint() {
-					case "smallweb:webdav":
-						handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-							w.Header().Set("Access-Control-Allow-Origin", "*")
-							w.Header().Set("Access-Control-Allow-Methods", "*")
-							w.Header().Set("Access-Control-Allow-Headers", "*")
-							if r.Method == "OPTIONS" {
-								return
-							}
+					a = app
+				}
 
-							webdavHandler.ServeHTTP(w, r)
-						})
-					case "smallweb:cli":
-						handler = cliHandler
-					case "smallweb:docs":
-						handler = docsHandler
-					case "smallweb:static":
-						handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-							w.Header().Set("Access-Control-Allow-Origin", "*")
-							w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-							w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-							if r.Method == "OPTIONS" {
-								return
-							}
-							http.FileServer(http.Dir(a.Root())).ServeHTTP(w, r)
-						})
-					case "smallweb:editor":
-						handler = editorHandler
-					default:
-						wk := worker.NewWorker(a, k.StringMap("env"))
-						if err := wk.StartServer(); err != nil {
-							http.Error(w, err.Error(), http.StatusInternalServerError)
+				release, ok := rateLimiter.Acquire(w, r, a)
+				if !ok {
+					return
+				}
+				defer release()
+
+				var handler http.Handler
+				switch a.Entrypoint() {
+				case "smallweb:webdav":
+					handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						w.Header().Set("Access-Control-Allow-Origin", "*")
+						w.Header().Set("Access-Control-Allow-Methods", "*")
+						w.Header().Set("Access-Control-Allow-Headers", "*")
+						if r.Method == "OPTIONS" {
 							return
 						}
-						defer wk.StopServer()
-						handler = wk
-					}
 
-					isPrivateRoute := a.Config.Private
-					for _, publicRoute := range a.Config.PublicRoutes {
-						glob := glob.MustCompile(publicRoute)
-						if glob.Match(r.URL.Path) {
-							isPrivateRoute = false
+						webdavHandler.ServeHTTP(w, r)
+					})
+				case "smallweb:cli":
+					handler = cliHandler
+				case "smallweb:docs":
+					handler = docsHandler
+				case "smallweb:static":
+					handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						w.Header().Set("Access-Control-Allow-Origin", "*")
+						w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+						w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+						if r.Method == "OPTIONS" {
+							return
 						}
-					}
+						http.FileServer(http.Dir(a.Root())).ServeHTTP(w, r)
+					})
+				case "smallweb:editor":
+					handler = editorHandler
+				default:
+					// the worker is only started once the request went
+					// through the auth middleware of private routes
+					handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						wk, err := pool.Get(a)
+						if err != nil {
+							var permissionError *app.PermissionError
+							if errors.As(err, &permissionError) {
+								http.Error(w, fmt.Sprintf("app %s could not start: %v", a.Name, err), http.StatusForbidden)
+								return
+							}
 
-					for _, privateRoute := range a.Config.PrivateRoutes {
-						glob := glob.MustCompile(privateRoute)
-						if glob.Match(r.URL.Path) {
-							isPrivateRoute = true
+							http.Error(w, err.Error(), http.StatusInternalServerError)
+							return
 						}
-					}
-
-					if isPrivateRoute || strings.HasPrefix(r.URL.Path, "/_auth") {
-						handler = authMiddleware.Wrap(handler, k.String("email"))
-					}
-
-					handler.ServeHTTP(w, r)
-				}), logger),
-			}
+						defer pool.Release(wk)
 
-			parser := cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
-			c := cron.New(cron.WithParser(parser))
-			c.AddFunc("* * * * *", func() {
-				rootDir := utils.ExpandTilde(k.String("dir"))
-				rounded := time.Now().Truncate(time.Minute)
-				apps, err := app.ListApps(rootDir)
-				if err != nil {
-					fmt.Println(err)
+						wk.ServeHTTP(w, r)
+					})
 				}
 
-				for _, name := range apps {
-					a, err := app.LoadApp(filepath.Join(rootDir, name), k.String("domain"))
-					if err != nil {
-						fmt.Println(err)
-						continue
+				isPrivateRoute := a.Config.Private
+				for _, publicRoute := range a.Config.PublicRoutes {
+					glob := glob.MustCompile(publicRoute)
+					if glob.Match(r.URL.Path) {
+						isPrivateRoute = false
 					}
+				}
 
-					for _, job := range a.Config.Crons {
-						sched, err := parser.Parse(job.Schedule)
-						if err != nil {
-							fmt.Println(err)
-							continue
-						}
+				for _, privateRoute := range a.Config.PrivateRoutes {
+					glob := glob.MustCompile(privateRoute)
+					if glob.Match(r.URL.Path) {
+						isPrivateRoute = true
+					}
+				}
 
-						if sched.Next(rounded.Add(-1*time.Second)) != rounded {
-							continue
-						}
+				if isPrivateRoute || strings.HasPrefix(r.URL.Path, "/_auth") {
+					handler = authMiddleware.Wrap(handler, a)
+				}
 
-						wk := worker.NewWorker(a, k.StringMap("env"))
+				handler.ServeHTTP(w, r)
+			})
 
-						command, err := wk.Command(job.Args...)
-						if err != nil {
-							fmt.Println(err)
-							continue
-						}
+			addr := fmt.Sprintf("%s:%d", k.String("host"), port)
+			server := http.Server{
+				Addr: addr,
+				// read and write timeouts are set per request by the workers,
+				// as streaming routes need to opt out of them. The header and
+				// idle timeouts only bound clients, not apps, so they do not
+				// depend on the timeouts config.
+				ReadHeaderTimeout: 10 * time.Second,
+				IdleTimeout:       2 * time.Minute,
+				Handler:           loggingMiddleware(router, logger),
+			}
 
-						if err := command.Run(); err != nil {
-							fmt.Println(err)
-						}
-					}
+			// cancelled on shutdown, to stop waiting for retries
+			cronCtx, cancelCron := context.WithCancel(context.Background())
+			defer cancelCron()
 
-				}
+			scheduler := &cronScheduler{db: db, logStore: logStore, handler: router, apps: appWatcher.Apps}
+			c := cron.New(cron.WithParser(cronParser))
+			c.AddFunc("* * * * *", func() {
+				scheduler.Tick(cronCtx, time.Now())
 			})
 
+			// catch up on the runs missed while smallweb was not running
+			go scheduler.Tick(cronCtx, time.Now())
 			go c.Start()
 
+			janitorCtx, cancelJanitor := context.WithCancel(context.Background())
+			defer cancelJanitor()
+			go cleanSessions(janitorCtx, db, time.Hour)
+
+			go func() {
+				sigs := make(chan os.Signal, 1)
+				signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+				<-sigs
+				server.Shutdown(context.Background())
+			}()
+
 			if cert != "" || key != "" {
 				if cert == "" {
 					return fmt.Errorf("TLS certificate file is required")
@@ -630,11 +877,48 @@ func NewCmdUp(db *sql.DB) *cobra.Command {
 				}
 
 				cmd.Printf("Serving %s from %s on %s\n", k.String("domain"), k.String("dir"), addr)
-				return server.ListenAndServeTLS(utils.ExpandTilde(cert), utils.ExpandTilde(key))
+				if err := server.ListenAndServeTLS(utils.ExpandTilde(cert), utils.ExpandTilde(key)); !errors.Is(err, http.ErrServerClosed) {
+					return err
+				}
+
+				return nil
+			}
+
+			if k.Exists("acme") {
+				certManager, err := newCertManager(appWatcher, domain)
+				if err != nil {
+					return fmt.Errorf("failed to create certificate manager: %w", err)
+				}
+
+				server.TLSConfig = certManager.TLSConfig()
+				cmd.Printf("Serving *.%s from %s on %s, using acme certificates\n", k.String("domain"), k.String("dir"), addr)
+				if err := server.ListenAndServeTLS("", ""); !errors.Is(err, http.ErrServerClosed) {
+					return err
+				}
+
+				return nil
+			}
+
+			if utils.FileExists(localCACertPath) {
+				certificates := &localCertificates{
+					hosts: func() []string { return appHosts(domain, appWatcher.Apps(), appWatcher.Domains()) },
+				}
+
+				server.TLSConfig = &tls.Config{GetCertificate: certificates.GetCertificate}
+				cmd.Printf("Serving *.%s from %s on %s, using the local CA\n", k.String("domain"), k.String("dir"), addr)
+				if err := server.ListenAndServeTLS("", ""); !errors.Is(err, http.ErrServerClosed) {
+					return err
+				}
+
+				return nil
 			}
 
 			cmd.Printf("Serving *.%s from %s on %s\n", k.String("domain"), k.String("dir"), addr)
-			return server.ListenAndServe()
+			if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+
+			return nil
 		},
 	}
 
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Ban prevents an ip or a token from authenticating until it expires.
+type Ban struct {
+	Key       string    `json:"key"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func UpsertBan(db *sql.DB, ban Ban) error {
+	_, err := db.Exec("INSERT INTO bans (key, reason, createdAt, expiresAt) VALUES (?, ?, ?, ?) ON CONFLICT(key) DO UPDATE SET reason = excluded.reason, createdAt = excluded.createdAt, expiresAt = excluded.expiresAt", ban.Key, ban.Reason, ban.CreatedAt, ban.ExpiresAt)
+	return err
+}
+
+func GetBan(db *sql.DB, key string) (Ban, error) {
+	ban := Ban{}
+	err := db.QueryRow("SELECT key, reason, createdAt, expiresAt FROM bans WHERE key = ?", key).Scan(&ban.Key, &ban.Reason, &ban.CreatedAt, &ban.ExpiresAt)
+	return ban, err
+}
+
+func ListBans(db *sql.DB) ([]Ban, error) {
+	rows, err := db.Query("SELECT key, reason, createdAt, expiresAt FROM bans")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bans := []Ban{}
+	for rows.Next() {
+		ban := Ban{}
+		if err := rows.Scan(&ban.Key, &ban.Reason, &ban.CreatedAt, &ban.ExpiresAt); err != nil {
+			return nil, err
+		}
+		bans = append(bans, ban)
+	}
+
+	return bans, rows.Err()
+}
+
+func DeleteBan(db *sql.DB, key string) error {
+	res, err := db.Exec("DELETE FROM bans WHERE key = ?", key)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+const (
+	CronRunRunning = "running"
+	CronRunSuccess = "success"
+	CronRunFailed  = "failed"
+	CronRunTimeout = "timeout"
+	CronRunSkipped = "skipped"
+)
+
+const (
+	CronSourceSchedule = "schedule"
+	CronSourceManual   = "manual"
+	CronSourceCatchup  = "catchup"
+)
+
+// CronRun records an execution of a cron job. The output is truncated
+// before being stored.
+type CronRun struct {
+	ID         string     `json:"id"`
+	Job        string     `json:"job"`
+	App        string     `json:"app"`
+	Source     string     `json:"source"`
+	Status     string     `json:"status"`
+	Attempt    int        `json:"attempt"`
+	StartedAt  time.Time  `json:"startedAt"`
+	EndedAt    *time.Time `json:"endedAt,omitempty"`
+	ExitCode   *int       `json:"exitCode,omitempty"`
+	StatusCode *int       `json:"statusCode,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Stdout     string     `json:"stdout"`
+	Stderr     string     `json:"stderr"`
+}
+
+const cronRunColumns = "id, job, app, source, status, attempt, startedAt, endedAt, exitCode, error, stdout, stderr, statusCode"
+
+func InsertCronRun(db *sql.DB, run *CronRun) error {
+	_, err := db.Exec("INSERT INTO cron_runs ("+cronRunColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", run.ID, run.Job, run.App, run.Source, run.Status, run.Attempt, run.StartedAt, run.EndedAt, run.ExitCode, run.Error, run.Stdout, run.Stderr, run.StatusCode)
+	return err
+}
+
+func UpdateCronRun(db *sql.DB, run *CronRun) error {
+	_, err := db.Exec("UPDATE cron_runs SET status = ?, endedAt = ?, exitCode = ?, error = ?, stdout = ?, stderr = ?, statusCode = ? WHERE id = ?", run.Status, run.EndedAt, run.ExitCode, run.Error, run.Stdout, run.Stderr, run.StatusCode, run.ID)
+	return err
+}
+
+func GetCronRun(db *sql.DB, id string) (CronRun, error) {
+	return scanCronRun(db.QueryRow("SELECT "+cronRunColumns+" FROM cron_runs WHERE id = ?", id))
+}
+
+// ListCronRuns returns the most recent runs first. An empty job matches every
+// job, and a limit lower or equal to zero returns every run.
+func ListCronRuns(db *sql.DB, job string, limit int) ([]CronRun, error) {
+	query := "SELECT " + cronRunColumns + " FROM cron_runs"
+	var args []any
+	if job != "" {
+		query += " WHERE job = ?"
+		args = append(args, job)
+	}
+
+	query += " ORDER BY rowid DESC"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []CronRun{}
+	for rows.Next() {
+		run, err := scanCronRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+func scanCronRun(row scanner) (CronRun, error) {
+	run := CronRun{}
+	var endedAt sql.NullTime
+	var exitCode, statusCode sql.NullInt64
+	if err := row.Scan(&run.ID, &run.Job, &run.App, &run.Source, &run.Status, &run.Attempt, &run.StartedAt, &endedAt, &exitCode, &run.Error, &run.Stdout, &run.Stderr, &statusCode); err != nil {
+		return CronRun{}, err
+	}
+
+	if endedAt.Valid {
+		run.EndedAt = &endedAt.Time
+	}
+
+	if exitCode.Valid {
+		code := int(exitCode.Int64)
+		run.ExitCode = &code
+	}
+
+	if statusCode.Valid {
+		code := int(statusCode.Int64)
+		run.StatusCode = &code
+	}
+
+	return run, nil
+}
+
+// CronJobState tracks the fire times of a job. LastFiredAt is the last fire
+// time the scheduler attempted, and LastSucceededAt the last one whose run
+// succeeded.
+type CronJobState struct {
+	Job             string     `json:"job"`
+	LastFiredAt     time.Time  `json:"lastFiredAt"`
+	LastSucceededAt *time.Time `json:"lastSucceededAt,omitempty"`
+}
+
+func GetCronJobState(db *sql.DB, job string) (CronJobState, error) {
+	state := CronJobState{Job: job}
+	var lastSucceededAt sql.NullTime
+	if err := db.QueryRow("SELECT lastFiredAt, lastSucceededAt FROM cron_jobs WHERE job = ?", job).Scan(&state.LastFiredAt, &lastSucceededAt); err != nil {
+		return CronJobState{}, err
+	}
+
+	if lastSucceededAt.Valid {
+		state.LastSucceededAt = &lastSucceededAt.Time
+	}
+
+	return state, nil
+}
+
+func SetCronLastFire(db *sql.DB, job string, lastFiredAt time.Time) error {
+	_, err := db.Exec("INSERT INTO cron_jobs (job, lastFiredAt) VALUES (?, ?) ON CONFLICT(job) DO UPDATE SET lastFiredAt = excluded.lastFiredAt", job, lastFiredAt)
+	return err
+}
+
+func SetCronLastSuccess(db *sql.DB, job string, lastSucceededAt time.Time) error {
+	_, err := db.Exec("INSERT INTO cron_jobs (job, lastFiredAt, lastSucceededAt) VALUES (?, ?, ?) ON CONFLICT(job) DO UPDATE SET lastSucceededAt = excluded.lastSucceededAt", job, lastSucceededAt, lastSucceededAt)
+	return err
+}
@@ -0,0 +1,145 @@
+package database
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// legacy schemas, as created before the database was versioned
+const (
+	baselineSchema = `
+CREATE TABLE tokens (
+	id TEXT PRIMARY KEY,
+	hash TEXT NOT NULL,
+	description TEXT,
+	createdAt TIMESTAMP NOT NULL
+);
+
+CREATE TABLE sessions (
+	id TEXT PRIMARY KEY,
+	email TEXT NOT NULL,
+	domain TEXT NOT NULL,
+	createdAt TIMESTAMP NOT NULL,
+	expiresAt TIMESTAMP NOT NULL
+);
+`
+	scopesSchema = baselineSchema + `
+ALTER TABLE tokens ADD COLUMN apps TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE tokens ADD COLUMN scopes TEXT NOT NULL DEFAULT '[]';
+`
+	usageSchema = scopesSchema + `
+ALTER TABLE tokens ADD COLUMN expiresAt TIMESTAMP;
+ALTER TABLE tokens ADD COLUMN lastUsedAt TIMESTAMP;
+ALTER TABLE tokens ADD COLUMN lastUsedIp TEXT;
+`
+)
+
+func TestMigrate(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := migrations[len(migrations)-1].Version
+
+	tests := []struct {
+		name   string
+		schema string
+		// first is the first migration applied by Migrate
+		first int
+	}{
+		{name: "fresh database", first: 1},
+		{name: "baseline schema", schema: baselineSchema, first: 2},
+		{name: "token scopes", schema: scopesSchema, first: 3},
+		{name: "token usage", schema: usageSchema, first: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := OpenDB(filepath.Join(t.TempDir(), "smallweb.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			if tt.schema != "" {
+				if _, err := db.Exec(tt.schema); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			applied, err := Migrate(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(applied) == 0 {
+				t.Fatal("no migration was applied")
+			}
+
+			if len(applied) != latest-tt.first+1 || applied[0].Version != tt.first {
+				t.Fatalf("applied %d migrations starting at %d, want %d starting at %d", len(applied), applied[0].Version, latest-tt.first+1, tt.first)
+			}
+
+			statuses, err := Status(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, status := range statuses {
+				if status.AppliedAt == nil {
+					t.Errorf("migration %04d_%s is not recorded", status.Version, status.Name)
+				}
+			}
+
+			var version int
+			if err := db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+				t.Fatal(err)
+			}
+
+			if version != latest {
+				t.Errorf("schema version is %d, want %d", version, latest)
+			}
+
+			applied, err = Migrate(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(applied) != 0 {
+				t.Errorf("second run applied %d migrations, want none", len(applied))
+			}
+		})
+	}
+}
+
+func TestMigrateKeepsLegacyData(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "smallweb.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec("INSERT INTO tokens (id, hash, description, createdAt) VALUES ('legacy', 'hash', 'legacy token', CURRENT_TIMESTAMP)"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var apps, scopes string
+	var lastUsedAt sql.NullTime
+	if err := db.QueryRow("SELECT apps, scopes, lastUsedAt FROM tokens WHERE id = 'legacy'").Scan(&apps, &scopes, &lastUsedAt); err != nil {
+		t.Fatal(err)
+	}
+
+	// legacy tokens keep access to every app and service
+	if apps != "[]" || scopes != `["cli","webdav:write"]` || lastUsedAt.Valid {
+		t.Errorf("got apps %s, scopes %s and lastUsedAt %v", apps, scopes, lastUsedAt)
+	}
+}
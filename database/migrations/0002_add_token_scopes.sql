@@ -0,0 +1,5 @@
+ALTER TABLE tokens ADD COLUMN apps TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE tokens ADD COLUMN scopes TEXT NOT NULL DEFAULT '[]';
+
+-- existing tokens keep access to every app and service
+UPDATE tokens SET scopes = '["cli","webdav:write"]';
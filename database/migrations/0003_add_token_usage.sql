@@ -0,0 +1,3 @@
+ALTER TABLE tokens ADD COLUMN expiresAt TIMESTAMP;
+ALTER TABLE tokens ADD COLUMN lastUsedAt TIMESTAMP;
+ALTER TABLE tokens ADD COLUMN lastUsedIp TEXT;
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS bans (
+    key TEXT PRIMARY KEY,
+    reason TEXT NOT NULL,
+    createdAt TIMESTAMP NOT NULL,
+    expiresAt TIMESTAMP NOT NULL
+);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS oom_kills (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    app TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    createdAt TIMESTAMP NOT NULL
+);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS cron_runs (
+    id TEXT PRIMARY KEY,
+    job TEXT NOT NULL,
+    app TEXT NOT NULL,
+    source TEXT NOT NULL,
+    status TEXT NOT NULL,
+    startedAt TIMESTAMP NOT NULL,
+    endedAt TIMESTAMP,
+    exitCode INTEGER,
+    error TEXT NOT NULL DEFAULT '',
+    stdout TEXT NOT NULL DEFAULT '',
+    stderr TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS cron_runs_job ON cron_runs (job);
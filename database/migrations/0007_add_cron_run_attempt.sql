@@ -0,0 +1 @@
+ALTER TABLE cron_runs ADD COLUMN attempt INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS cron_jobs (
+    job TEXT PRIMARY KEY,
+    lastFiredAt TIMESTAMP NOT NULL
+);
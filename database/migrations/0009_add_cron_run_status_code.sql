@@ -0,0 +1 @@
+ALTER TABLE cron_runs ADD COLUMN statusCode INTEGER;
@@ -0,0 +1,2 @@
+ALTER TABLE cron_jobs ADD COLUMN lastSucceededAt TIMESTAMP;
+UPDATE cron_jobs SET lastSucceededAt = lastFiredAt;
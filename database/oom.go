@@ -0,0 +1,47 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// OOMKill records an app worker killed for exceeding its memory limits.
+type OOMKill struct {
+	ID        int64     `json:"id"`
+	App       string    `json:"app"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func InsertOOMKill(db *sql.DB, kill OOMKill) error {
+	_, err := db.Exec("INSERT INTO oom_kills (app, reason, createdAt) VALUES (?, ?, ?)", kill.App, kill.Reason, kill.CreatedAt)
+	return err
+}
+
+// ListOOMKills returns the most recent kills first. An empty app matches
+// every app.
+func ListOOMKills(db *sql.DB, app string) ([]OOMKill, error) {
+	query := "SELECT id, app, reason, createdAt FROM oom_kills"
+	var args []any
+	if app != "" {
+		query += " WHERE app = ?"
+		args = append(args, app)
+	}
+
+	rows, err := db.Query(query+" ORDER BY id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	kills := []OOMKill{}
+	for rows.Next() {
+		kill := OOMKill{}
+		if err := rows.Scan(&kill.ID, &kill.App, &kill.Reason, &kill.CreatedAt); err != nil {
+			return nil, err
+		}
+		kills = append(kills, kill)
+	}
+
+	return kills, rows.Err()
+}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"database/sql"
+	"strings"
 	"time"
 )
 
@@ -13,18 +14,6 @@ type Session struct {
 	ExpiresAt time.Time `json:"expiresAt"`
 }
 
-func CreateSessionTable(db *sql.DB) error {
-	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
-		id TEXT PRIMARY KEY,
-		email TEXT NOT NULL,
-		domain TEXT NOT NULL,
-		createdAt TIMESTAMP NOT NULL,
-		expiresAt TIMESTAMP NOT NULL
-	)`)
-
-	return err
-}
-
 func InsertSession(db *sql.DB, session *Session) error {
 	_, err := db.Exec("INSERT INTO sessions (id, email, domain, createdAt, expiresAt) VALUES (?, ?, ?, ?, ?)", session.ID, session.Email, session.Domain, session.CreatedAt, session.ExpiresAt)
 	return err
@@ -45,3 +34,85 @@ func DeleteSession(db *sql.DB, id string) error {
 	_, err := db.Exec("DELETE FROM sessions WHERE id = ?", id)
 	return err
 }
+
+// SessionFilter restricts the sessions matched by ListSessions and
+// DeleteSessions. Empty fields match every session.
+type SessionFilter struct {
+	Email  string
+	Domain string
+}
+
+func (me SessionFilter) where() (string, []any) {
+	var conditions []string
+	var args []any
+	if me.Email != "" {
+		conditions = append(conditions, "email = ?")
+		args = append(args, me.Email)
+	}
+
+	if me.Domain != "" {
+		conditions = append(conditions, "domain = ?")
+		args = append(args, me.Domain)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func ListSessions(db *sql.DB, filter SessionFilter) ([]Session, error) {
+	where, args := filter.where()
+	rows, err := db.Query("SELECT id, email, domain, createdAt, expiresAt FROM sessions"+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session := Session{}
+		if err := rows.Scan(&session.ID, &session.Email, &session.Domain, &session.CreatedAt, &session.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// DeleteSessions deletes the sessions matching the filter, and returns how
+// many were deleted.
+func DeleteSessions(db *sql.DB, filter SessionFilter) (int64, error) {
+	where, args := filter.where()
+	res, err := db.Exec("DELETE FROM sessions"+where, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// DeleteExpiredSessions deletes the sessions expired at the given time. The
+// dates are compared in go, as sqlite stores them as text.
+func DeleteExpiredSessions(db *sql.DB, now time.Time) (int64, error) {
+	sessions, err := ListSessions(db, SessionFilter{})
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for _, session := range sessions {
+		if now.Before(session.ExpiresAt) {
+			continue
+		}
+
+		if err := DeleteSession(db, session.ID); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
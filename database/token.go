@@ -2,40 +2,63 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"time"
 )
 
 type Token struct {
-	ID          string    `json:"id"`
-	Hash        []byte    `json:"hash"`
-	Description string    `json:"description"`
-	CreatedAt   time.Time `json:"createdAt"`
+	ID          string     `json:"id"`
+	Hash        []byte     `json:"hash"`
+	Description string     `json:"description"`
+	Apps        []string   `json:"apps"`
+	Scopes      []string   `json:"scopes"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt  *time.Time `json:"lastUsedAt,omitempty"`
+	LastUsedIP  string     `json:"lastUsedIp,omitempty"`
 }
 
-func CreateTokenTable(db *sql.DB) error {
-	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS tokens (
-		id TEXT PRIMARY KEY,
-		hash TEXT NOT NULL,
-		description TEXT,
-		createdAt TIMESTAMP NOT NULL
-	)`)
+func InsertToken(db *sql.DB, token Token) error {
+	apps, err := json.Marshal(emptyIfNil(token.Apps))
+	if err != nil {
+		return err
+	}
 
+	scopes, err := json.Marshal(emptyIfNil(token.Scopes))
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT INTO tokens (id, hash, description, apps, scopes, createdAt, expiresAt) VALUES (?, ?, ?, ?, ?, ?, ?)", token.ID, token.Hash, token.Description, string(apps), string(scopes), token.CreatedAt, token.ExpiresAt)
 	return err
 }
 
-func InsertToken(db *sql.DB, token Token) error {
-	_, err := db.Exec("INSERT INTO tokens (id, hash, description, createdAt) VALUES (?, ?, ?, ?)", token.ID, token.Hash, token.Description, token.CreatedAt)
+// RotateToken replaces the hash of the token secret, and its expiry date.
+func RotateToken(db *sql.DB, id string, hash []byte, expiresAt *time.Time) error {
+	res, err := db.Exec("UPDATE tokens SET hash = ?, expiresAt = ? WHERE id = ?", hash, expiresAt, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func TouchToken(db *sql.DB, id string, ip string, usedAt time.Time) error {
+	_, err := db.Exec("UPDATE tokens SET lastUsedAt = ?, lastUsedIp = ? WHERE id = ?", usedAt, ip, id)
 	return err
 }
 
 func GetToken(db *sql.DB, id string) (Token, error) {
-	token := Token{}
-	err := db.QueryRow("SELECT id, hash, description, createdAt FROM tokens WHERE id = ?", id).Scan(&token.ID, &token.Hash, &token.Description, &token.CreatedAt)
-	return token, err
+	return scanToken(db.QueryRow("SELECT id, hash, description, apps, scopes, createdAt, expiresAt, lastUsedAt, lastUsedIp FROM tokens WHERE id = ?", id))
 }
 
 func ListTokens(db *sql.DB) ([]Token, error) {
-	rows, err := db.Query("SELECT id, hash, description, createdAt FROM tokens")
+	rows, err := db.Query("SELECT id, hash, description, apps, scopes, createdAt, expiresAt, lastUsedAt, lastUsedIp FROM tokens")
 	if err != nil {
 		return nil, err
 	}
@@ -43,8 +66,7 @@ func ListTokens(db *sql.DB) ([]Token, error) {
 
 	tokens := []Token{}
 	for rows.Next() {
-		token := Token{}
-		err := rows.Scan(&token.ID, &token.Hash, &token.Description, &token.CreatedAt)
+		token, err := scanToken(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -58,3 +80,44 @@ func DeleteToken(db *sql.DB, id string) error {
 	_, err := db.Exec("DELETE FROM tokens WHERE id = ?", id)
 	return err
 }
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanToken(row scanner) (Token, error) {
+	token := Token{}
+	var apps, scopes string
+	var expiresAt, lastUsedAt sql.NullTime
+	var lastUsedIP sql.NullString
+	if err := row.Scan(&token.ID, &token.Hash, &token.Description, &apps, &scopes, &token.CreatedAt, &expiresAt, &lastUsedAt, &lastUsedIP); err != nil {
+		return Token{}, err
+	}
+
+	if expiresAt.Valid {
+		token.ExpiresAt = &expiresAt.Time
+	}
+
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+	token.LastUsedIP = lastUsedIP.String
+
+	if err := json.Unmarshal([]byte(apps), &token.Apps); err != nil {
+		return Token{}, fmt.Errorf("invalid token apps: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(scopes), &token.Scopes); err != nil {
+		return Token{}, fmt.Errorf("invalid token scopes: %w", err)
+	}
+
+	return token, nil
+}
+
+func emptyIfNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+
+	return values
+}
@@ -0,0 +1,396 @@
+package logs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// DefaultMaxSize is the size after which the log of an app is rotated. Only
+// one rotated file is kept, so an app never uses more than twice this size.
+const DefaultMaxSize = 5 * 1024 * 1024
+
+// maxLineLength is the size after which a line without a newline is written
+// to the log anyway, split in several entries.
+const maxLineLength = 64 * 1024
+
+// pollInterval is how often a followed log is checked for new entries.
+const pollInterval = 500 * time.Millisecond
+
+type Entry struct {
+	Time   time.Time `json:"time"`
+	App    string    `json:"app"`
+	Stream string    `json:"stream"`
+	Text   string    `json:"text"`
+}
+
+// Store keeps the output of each app in a jsonl file, named after the app.
+type Store struct {
+	Dir     string
+	MaxSize int64
+
+	// mu only guards the files map, each log file has its own lock, so that
+	// a slow write does not block the logs of the other apps
+	mu    sync.Mutex
+	files map[string]*logFile
+}
+
+type logFile struct {
+	mu     sync.Mutex
+	closed bool
+	file   *os.File
+	// lock is shared with the other smallweb processes writing to the log
+	// (ex: smallweb cron trigger), so that they never rotate it concurrently
+	lock *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open log lock: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("could not open log: %w", err)
+	}
+
+	return &logFile{file: file, lock: lock}, nil
+}
+
+func (me *logFile) reopen(path string) error {
+	me.file.Close()
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open log: %w", err)
+	}
+
+	me.file = file
+	return nil
+}
+
+func (me *logFile) Close() error {
+	return errors.Join(me.file.Close(), me.lock.Close())
+}
+
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create log directory: %w", err)
+	}
+
+	return &Store{
+		Dir:     dir,
+		MaxSize: DefaultMaxSize,
+		files:   make(map[string]*logFile),
+	}, nil
+}
+
+func (me *Store) path(app string) (string, error) {
+	if app == "" || app != filepath.Base(app) || strings.HasPrefix(app, ".") {
+		return "", fmt.Errorf("invalid app name: %s", app)
+	}
+
+	return filepath.Join(me.Dir, app+".jsonl"), nil
+}
+
+// Append writes an entry to the log of its app, rotating the log if it
+// exceeds the maximum size.
+func (me *Store) Append(entry Entry) error {
+	path, err := me.path(entry.App)
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	f, err := me.lockFile(entry.App, path)
+	if err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+
+	if err := syscall.Flock(int(f.lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("could not lock log: %w", err)
+	}
+	defer syscall.Flock(int(f.lock.Fd()), syscall.LOCK_UN)
+
+	// another process may have rotated the log since it was opened
+	if rotated, err := isRotated(f.file, path); err != nil || rotated {
+		if err := f.reopen(path); err != nil {
+			return err
+		}
+	}
+
+	info, err := f.file.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat log: %w", err)
+	}
+
+	if info.Size() > 0 && info.Size()+int64(len(line)) > me.MaxSize {
+		if err := os.Rename(path, path+".1"); err != nil {
+			return fmt.Errorf("could not rotate log: %w", err)
+		}
+
+		if err := f.reopen(path); err != nil {
+			return err
+		}
+	}
+
+	_, err = f.file.Write(line)
+	return err
+}
+
+// lockFile returns the open log file of the app, opening it if needed, with
+// its lock held.
+func (me *Store) lockFile(app string, path string) (*logFile, error) {
+	for {
+		me.mu.Lock()
+		f, ok := me.files[app]
+		if !ok {
+			var err error
+			if f, err = openLogFile(path); err != nil {
+				me.mu.Unlock()
+				return nil, err
+			}
+
+			me.files[app] = f
+		}
+		me.mu.Unlock()
+
+		f.mu.Lock()
+		if !f.closed {
+			return f, nil
+		}
+
+		// the store was closed in the meantime, the log is opened again
+		f.mu.Unlock()
+	}
+}
+
+// Writer returns a writer adding each line written to the log of the app.
+// Close must be called to flush the last line if it does not end with a
+// newline.
+func (me *Store) Writer(app string, stream string) io.WriteCloser {
+	return &lineWriter{store: me, app: app, stream: stream}
+}
+
+// Close closes the open log files.
+func (me *Store) Close() error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	var errs []error
+	for app, f := range me.files {
+		f.mu.Lock()
+		errs = append(errs, f.Close())
+		f.closed = true
+		f.mu.Unlock()
+		delete(me.files, app)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Tail calls fn for each entry of the app log written since the given time.
+// If follow is true, it then waits for new entries until the context is
+// cancelled.
+func (me *Store) Tail(ctx context.Context, app string, since time.Time, follow bool, fn func(Entry) error) error {
+	path, err := me.path(app)
+	if err != nil {
+		return err
+	}
+
+	if file, err := os.Open(path + ".1"); err == nil {
+		_, err := readEntries(bufio.NewReader(file), since, fn)
+		file.Close()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+
+	var file *os.File
+	for {
+		file, err = os.Open(path)
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("could not open log: %w", err)
+		}
+
+		if !follow {
+			return nil
+		}
+
+		if err := sleep(ctx, pollInterval); err != nil {
+			return nil
+		}
+	}
+	defer func() { file.Close() }()
+
+	reader := bufio.NewReader(file)
+	var partial []byte
+	for {
+		partial, err = readEntries(reader, since, fn, partial...)
+		if !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		if !follow {
+			return nil
+		}
+
+		if err := sleep(ctx, pollInterval); err != nil {
+			return nil
+		}
+
+		// once rotated, the current file is drained before switching to the new one
+		rotated, err := isRotated(file, path)
+		if err != nil || !rotated {
+			continue
+		}
+
+		if partial, err = readEntries(reader, since, fn, partial...); !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		next, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+
+		file.Close()
+		file = next
+		reader = bufio.NewReader(file)
+		partial = nil
+	}
+}
+
+// readEntries reads the entries until the end of the reader, and returns the
+// last line if it is incomplete.
+func readEntries(reader *bufio.Reader, since time.Time, fn func(Entry) error, partial ...byte) ([]byte, error) {
+	line := partial
+	for {
+		chunk, err := reader.ReadBytes('\n')
+		line = append(line, chunk...)
+		if err != nil {
+			return line, err
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err == nil && !entry.Time.Before(since) {
+			if err := fn(entry); err != nil {
+				return nil, err
+			}
+		}
+
+		line = nil
+	}
+}
+
+func isRotated(file *os.File, path string) (bool, error) {
+	current, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	return !os.SameFile(current, info), nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+type lineWriter struct {
+	store  *Store
+	app    string
+	stream string
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (me *lineWriter) Write(p []byte) (int, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	me.buf = append(me.buf, p...)
+	for {
+		i := bytes.IndexByte(me.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		// logs are best effort, a failure must not block the process output
+		me.append(string(me.buf[:i]))
+		me.buf = me.buf[i+1:]
+	}
+
+	for len(me.buf) > maxLineLength {
+		// the line is split on a rune boundary, to keep the entries valid utf-8
+		cut := maxLineLength
+		for cut > maxLineLength-utf8.UTFMax && !utf8.RuneStart(me.buf[cut]) {
+			cut--
+		}
+
+		me.append(string(me.buf[:cut]))
+		me.buf = me.buf[cut:]
+	}
+
+	return len(p), nil
+}
+
+func (me *lineWriter) Close() error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if len(me.buf) == 0 {
+		return nil
+	}
+
+	err := me.append(string(me.buf))
+	me.buf = nil
+	return err
+}
+
+func (me *lineWriter) append(text string) error {
+	return me.store.Append(Entry{
+		Time:   time.Now(),
+		App:    me.app,
+		Stream: me.stream,
+		Text:   strings.TrimSuffix(text, "\r"),
+	})
+}
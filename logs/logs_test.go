@@ -0,0 +1,203 @@
+package logs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T, maxSize int64) *Store {
+	t.Helper()
+
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	store.MaxSize = maxSize
+	return store
+}
+
+func appendEntries(t *testing.T, store *Store, from int, to int) {
+	t.Helper()
+
+	for i := from; i < to; i++ {
+		if err := store.Append(Entry{Time: time.Now(), App: "example", Stream: StreamStdout, Text: fmt.Sprintf("line %d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readAll(t *testing.T, store *Store) []string {
+	t.Helper()
+
+	var lines []string
+	if err := store.Tail(context.Background(), "example", time.Time{}, false, func(entry Entry) error {
+		lines = append(lines, entry.Text)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return lines
+}
+
+func TestStoreRotation(t *testing.T) {
+	store := newTestStore(t, 1024)
+	appendEntries(t, store, 0, 100)
+
+	info, err := os.Stat(filepath.Join(store.Dir, "example.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size() > store.MaxSize {
+		t.Errorf("log size is %d, want at most %d", info.Size(), store.MaxSize)
+	}
+
+	lines := readAll(t, store)
+	if len(lines) == 0 || lines[len(lines)-1] != "line 99" {
+		t.Errorf("got %v, want the last entries", lines)
+	}
+}
+
+func TestStoreSharedBetweenProcesses(t *testing.T) {
+	store := newTestStore(t, 1024)
+	other := &Store{Dir: store.Dir, MaxSize: store.MaxSize, files: make(map[string]*logFile)}
+	defer other.Close()
+
+	appendEntries(t, store, 0, 1)
+	// the other store rotates the log, while the first one keeps it open
+	appendEntries(t, other, 1, 20)
+	appendEntries(t, store, 20, 21)
+
+	lines := readAll(t, store)
+	if len(lines) == 0 || lines[len(lines)-1] != "line 20" {
+		t.Errorf("got %v, want line 20 to be written to the current log", lines)
+	}
+
+	for i := 1; i < len(lines); i++ {
+		var previous, current int
+		fmt.Sscanf(lines[i-1], "line %d", &previous)
+		fmt.Sscanf(lines[i], "line %d", &current)
+		if current != previous+1 {
+			t.Fatalf("entries are out of order: %v", lines)
+		}
+	}
+}
+
+func TestStoreLocksEachApp(t *testing.T) {
+	store := newTestStore(t, 1024)
+	appendEntries(t, store, 0, 1)
+
+	// a write to the log of an app stalls, ex: another process holds its lock
+	f := store.files["example"]
+	f.mu.Lock()
+
+	done := make(chan error)
+	go func() {
+		done <- store.Append(Entry{Time: time.Now(), App: "other", Stream: StreamStdout, Text: "hello"})
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the logs of other apps should not be blocked")
+	}
+
+	f.mu.Unlock()
+	appendEntries(t, store, 1, 2)
+	if lines := readAll(t, store); len(lines) != 2 {
+		t.Errorf("got %v, want 2 entries", lines)
+	}
+}
+
+func TestStoreAppendAfterClose(t *testing.T) {
+	store := newTestStore(t, 1024)
+	appendEntries(t, store, 0, 1)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the log is opened again
+	appendEntries(t, store, 1, 2)
+	if lines := readAll(t, store); len(lines) != 2 {
+		t.Errorf("got %v, want 2 entries", lines)
+	}
+}
+
+func TestTailFollowsRotation(t *testing.T) {
+	store := newTestStore(t, 1024)
+	appendEntries(t, store, 0, 5)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	lines := make(chan string)
+	go store.Tail(ctx, "example", time.Time{}, true, func(entry Entry) error {
+		lines <- entry.Text
+		return nil
+	})
+
+	next := 0
+	expect := func(to int) {
+		for ; next < to; next++ {
+			select {
+			case line := <-lines:
+				if want := fmt.Sprintf("line %d", next); line != want {
+					t.Fatalf("got %s, want %s", line, want)
+				}
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for line %d", next)
+			}
+		}
+	}
+
+	expect(5)
+	// enough entries to rotate the log, without rotating it twice before
+	// the next poll
+	appendEntries(t, store, 5, 20)
+	expect(20)
+
+	if _, err := os.Stat(filepath.Join(store.Dir, "example.jsonl.1")); err != nil {
+		t.Fatalf("expected the log to be rotated: %v", err)
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	store := newTestStore(t, DefaultMaxSize)
+	writer := store.Writer("example", StreamStderr)
+
+	writer.Write([]byte("first "))
+	writer.Write([]byte("line\nsecond"))
+	writer.Write([]byte(" line\r\n"))
+	writer.Write([]byte(strings.Repeat("é", maxLineLength)))
+	writer.Write([]byte("\nunterminated"))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := readAll(t, store)
+	if len(lines) < 5 || lines[0] != "first line" || lines[1] != "second line" || lines[len(lines)-1] != "unterminated" {
+		t.Fatalf("got %d lines: %.80q", len(lines), lines)
+	}
+
+	long := strings.Join(lines[2:len(lines)-1], "")
+	if long != strings.Repeat("é", maxLineLength) {
+		t.Error("long line was not split on rune boundaries")
+	}
+
+	for _, line := range lines[2 : len(lines)-1] {
+		if len(line) > maxLineLength {
+			t.Errorf("got a line of %d bytes, want at most %d", len(line), maxLineLength)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// NewHTTPClient returns a client trusting the additional root certificate at
+// caPath, which is useful to test against local servers.
+func NewHTTPClient(caPath string) (*http.Client, error) {
+	if caPath == "" {
+		return http.DefaultClient, nil
+	}
+
+	caBytes, err := os.ReadFile(ExpandTilde(caPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA: %w", err)
+	}
+
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+
+	if !rootCAs.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("failed to parse CA")
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+		},
+	}, nil
+}
@@ -0,0 +1,379 @@
+package watcher
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pomdtr/smallweb/app"
+)
+
+const debounceDelay = 100 * time.Millisecond
+
+// Event is emitted when the files of an app change. Removed is set when the
+// app directory no longer exists.
+type Event struct {
+	App     string
+	Removed bool
+}
+
+// Watcher keeps an in-memory registry of the apps located in the root
+// directory, and reloads them when their files change.
+type Watcher struct {
+	rootDir    string
+	domain     string
+	authDomain string
+	fsWatcher  *fsnotify.Watcher
+
+	mu          sync.RWMutex
+	apps        map[string]app.App
+	domains     map[string]string
+	errors      map[string]error
+	timers      map[string]*time.Timer
+	subscribers []func(Event)
+}
+
+func NewWatcher(rootDir string, domain string, authDomain string) (*Watcher, error) {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("could not create watcher: %w", err)
+	}
+
+	watcher := &Watcher{
+		rootDir:    rootDir,
+		domain:     domain,
+		authDomain: authDomain,
+		fsWatcher:  fsWatcher,
+		apps:       make(map[string]app.App),
+		domains:    make(map[string]string),
+		errors:     make(map[string]error),
+		timers:     make(map[string]*time.Timer),
+	}
+
+	if err := fsWatcher.Add(rootDir); err != nil {
+		fsWatcher.Close()
+		return nil, fmt.Errorf("could not watch %s: %w", rootDir, err)
+	}
+
+	names, err := app.ListApps(rootDir)
+	if err != nil {
+		fsWatcher.Close()
+		return nil, err
+	}
+
+	for _, name := range names {
+		watcher.watchDir(filepath.Join(rootDir, name))
+		watcher.load(name)
+	}
+
+	return watcher, nil
+}
+
+// Start processes filesystem events until the watcher is closed.
+func (me *Watcher) Start() {
+	for {
+		select {
+		case event, ok := <-me.fsWatcher.Events:
+			if !ok {
+				return
+			}
+
+			me.handleEvent(event)
+		case err, ok := <-me.fsWatcher.Errors:
+			if !ok {
+				return
+			}
+
+			log.Printf("watcher error: %v", err)
+		}
+	}
+}
+
+func (me *Watcher) Close() error {
+	return me.fsWatcher.Close()
+}
+
+// Subscribe registers a callback invoked each time an app changes.
+func (me *Watcher) Subscribe(fn func(Event)) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	me.subscribers = append(me.subscribers, fn)
+}
+
+// GetApp returns the app with the given name from the registry.
+func (me *Watcher) GetApp(name string) (app.App, error) {
+	me.mu.RLock()
+	defer me.mu.RUnlock()
+
+	if err, ok := me.errors[name]; ok {
+		return app.App{}, err
+	}
+
+	a, ok := me.apps[name]
+	if !ok {
+		return app.App{}, fmt.Errorf("app not found: %s", name)
+	}
+
+	return a, nil
+}
+
+// LookupDomain returns the app which registered the custom domain in its CNAME file.
+func (me *Watcher) LookupDomain(domain string) (app.App, bool) {
+	me.mu.RLock()
+	defer me.mu.RUnlock()
+
+	name, ok := me.domains[strings.ToLower(domain)]
+	if !ok {
+		return app.App{}, false
+	}
+
+	a, ok := me.apps[name]
+	return a, ok
+}
+
+// Domains returns every custom domain registered by an app.
+func (me *Watcher) Domains() []string {
+	me.mu.RLock()
+	defer me.mu.RUnlock()
+
+	domains := make([]string, 0, len(me.domains))
+	for domain := range me.domains {
+		domains = append(domains, domain)
+	}
+
+	sort.Strings(domains)
+	return domains
+}
+
+// Apps returns every app of the registry which could be loaded, sorted by name.
+func (me *Watcher) Apps() []app.App {
+	me.mu.RLock()
+	defer me.mu.RUnlock()
+
+	apps := make([]app.App, 0, len(me.apps))
+	for _, a := range me.apps {
+		apps = append(apps, a)
+	}
+
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].Name < apps[j].Name
+	})
+
+	return apps
+}
+
+func (me *Watcher) load(name string) bool {
+	dir := filepath.Join(me.rootDir, name)
+	stat, err := os.Stat(dir)
+	exists := err == nil && stat.IsDir()
+
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	defer me.indexDomains()
+
+	delete(me.apps, name)
+	delete(me.errors, name)
+	if !exists {
+		return false
+	}
+
+	a, err := app.LoadApp(dir, me.domain)
+	if err != nil {
+		log.Printf("could not load app %s: %v", name, err)
+		me.errors[name] = err
+		return true
+	}
+
+	me.apps[name] = a
+	return true
+}
+
+func (me *Watcher) indexDomains() {
+	apps := make([]app.App, 0, len(me.apps))
+	for _, a := range me.apps {
+		apps = append(apps, a)
+	}
+
+	me.domains = IndexDomains(apps, me.domain, me.authDomain)
+	ResolveUrls(apps, me.domain, me.domains)
+	for _, a := range apps {
+		me.apps[a.Name] = a
+	}
+}
+
+// ResolveUrls sets the url of each app to its first custom domain accepted by
+// IndexDomains, falling back to the subdomain of the app.
+func ResolveUrls(apps []app.App, domain string, domains map[string]string) {
+	for i, a := range apps {
+		apps[i].Url = fmt.Sprintf("https://%s.%s/", a.Name, domain)
+		for _, custom := range a.Domains {
+			if domains[custom] == a.Name {
+				apps[i].Url = fmt.Sprintf("https://%s/", custom)
+				break
+			}
+		}
+	}
+}
+
+// IndexDomains maps the custom domains registered in the CNAME files to
+// their app. Domains served by smallweb itself (the root domain, its
+// subdomains and the auth domain) are rejected, so that an app can't take
+// over the host of another app. If several apps register the same domain,
+// the first one in alphabetical order wins. Every rejected domain is logged.
+func IndexDomains(apps []app.App, domain string, authDomain string) map[string]string {
+	apps = slices.Clone(apps)
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].Name < apps[j].Name
+	})
+
+	domains := make(map[string]string)
+	for _, a := range apps {
+		for _, custom := range a.Domains {
+			if custom == domain || strings.HasSuffix(custom, "."+domain) || (authDomain != "" && custom == authDomain) {
+				log.Printf("domain %s is reserved by smallweb, ignoring it for app %s", custom, a.Name)
+				continue
+			}
+
+			if other, ok := domains[custom]; ok {
+				log.Printf("domain %s is already registered by app %s, ignoring it for app %s", custom, other, a.Name)
+				continue
+			}
+
+			domains[custom] = a.Name
+		}
+	}
+
+	return domains
+}
+
+func (me *Watcher) watchDir(dir string) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		if path != dir && isIgnoredDir(d.Name()) {
+			return filepath.SkipDir
+		}
+
+		if err := me.fsWatcher.Add(path); err != nil {
+			log.Printf("could not watch %s: %v", path, err)
+		}
+
+		return nil
+	})
+}
+
+func (me *Watcher) handleEvent(event fsnotify.Event) {
+	rel, err := filepath.Rel(me.rootDir, event.Name)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return
+	}
+
+	parts := strings.Split(rel, string(filepath.Separator))
+	name := parts[0]
+	if strings.HasPrefix(name, ".") {
+		return
+	}
+
+	if len(parts) > 2 {
+		for _, part := range parts[1 : len(parts)-1] {
+			if isIgnoredDir(part) {
+				return
+			}
+		}
+	}
+
+	if event.Has(fsnotify.Create) {
+		if stat, err := os.Stat(event.Name); err == nil && stat.IsDir() {
+			if isIgnoredDir(stat.Name()) && len(parts) > 1 {
+				return
+			}
+
+			me.watchDir(event.Name)
+			me.schedule(name)
+			return
+		}
+	}
+
+	// root level files are not apps
+	if len(parts) == 1 {
+		if stat, err := os.Stat(event.Name); err == nil && !stat.IsDir() {
+			return
+		}
+
+		me.schedule(name)
+		return
+	}
+
+	if !isRelevantFile(parts[len(parts)-1]) {
+		return
+	}
+
+	me.schedule(name)
+}
+
+// schedule debounces the reload of an app, as editors usually emit several
+// events for a single save.
+func (me *Watcher) schedule(name string) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if timer, ok := me.timers[name]; ok {
+		timer.Reset(debounceDelay)
+		return
+	}
+
+	me.timers[name] = time.AfterFunc(debounceDelay, func() {
+		me.mu.Lock()
+		delete(me.timers, name)
+		me.mu.Unlock()
+
+		exists := me.load(name)
+
+		me.mu.RLock()
+		subscribers := me.subscribers
+		me.mu.RUnlock()
+
+		for _, fn := range subscribers {
+			fn(Event{App: name, Removed: !exists})
+		}
+	})
+}
+
+func isIgnoredDir(name string) bool {
+	return strings.HasPrefix(name, ".") || name == "node_modules"
+}
+
+// isRelevantFile reports whether a change to the file should reload the app.
+// On top of the code, static assets are included, as apps may read or embed
+// them at startup. Data files written by the app itself (sqlite databases,
+// uploads...) are ignored, so that they don't restart the worker serving the
+// app.
+func isRelevantFile(name string) bool {
+	if name == ".env" || name == "CNAME" {
+		return true
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".js", ".jsx", ".ts", ".tsx", ".mjs", ".mts", ".cjs", ".cts", ".json", ".jsonc", ".wasm":
+		return true
+	case ".html", ".htm", ".css", ".md", ".mdx", ".svg", ".txt", ".toml", ".yaml", ".yml":
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,144 @@
+package watcher
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pomdtr/smallweb/app"
+)
+
+func TestIndexDomains(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	apps := []app.App{
+		{Name: "zeta", Domains: []string{"shared.org", "zeta.org"}},
+		{Name: "alpha", Domains: []string{"shared.org", "alpha.org"}},
+		{Name: "evil", Domains: []string{"alpha.example.com", "example.com", "auth.org", "www.example.com", "evil.org"}},
+	}
+
+	domains := IndexDomains(apps, "example.com", "auth.org")
+	want := map[string]string{
+		"shared.org": "alpha",
+		"alpha.org":  "alpha",
+		"zeta.org":   "zeta",
+		"evil.org":   "evil",
+	}
+
+	if len(domains) != len(want) {
+		t.Fatalf("got %v, want %v", domains, want)
+	}
+
+	for domain, name := range want {
+		if domains[domain] != name {
+			t.Errorf("domain %s is registered by %q, want %q", domain, domains[domain], name)
+		}
+	}
+
+	for _, domain := range []string{"alpha.example.com", "example.com", "auth.org", "www.example.com"} {
+		if !strings.Contains(logs.String(), "domain "+domain+" is reserved by smallweb, ignoring it for app evil") {
+			t.Errorf("rejection of %s was not logged", domain)
+		}
+	}
+
+	if !strings.Contains(logs.String(), "domain shared.org is already registered by app alpha, ignoring it for app zeta") {
+		t.Errorf("collision was not logged")
+	}
+}
+
+func TestWatcherLookupDomain(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stderr)
+
+	rootDir := t.TempDir()
+	for name, cname := range map[string]string{
+		"blog": "blog.org\n",
+		"evil": "blog.example.com\nexample.com\nauth.org\n",
+	} {
+		dir := filepath.Join(rootDir, name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, "CNAME"), []byte(cname), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w, err := NewWatcher(rootDir, "example.com", "auth.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if a, ok := w.LookupDomain("blog.org"); !ok || a.Name != "blog" {
+		t.Errorf("blog.org should be routed to blog")
+	}
+
+	for _, host := range []string{"blog.example.com", "example.com", "auth.org"} {
+		if a, ok := w.LookupDomain(host); ok {
+			t.Errorf("%s should not be routed to %s", host, a.Name)
+		}
+	}
+
+	if domains := w.Domains(); len(domains) != 1 || domains[0] != "blog.org" {
+		t.Errorf("got domains %v, want [blog.org]", domains)
+	}
+
+	for name, url := range map[string]string{"blog": "https://blog.org/", "evil": "https://evil.example.com/"} {
+		if a, err := w.GetApp(name); err != nil || a.Url != url {
+			t.Errorf("got url %q for %s, want %q", a.Url, name, url)
+		}
+	}
+}
+
+func TestIsRelevantFile(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "main.ts", want: true},
+		{name: "smallweb.json", want: true},
+		{name: ".env", want: true},
+		{name: "CNAME", want: true},
+		{name: "index.html", want: true},
+		{name: "style.css", want: true},
+		{name: "README.md", want: true},
+		{name: "INDEX.HTML", want: true},
+		{name: "data.sqlite", want: false},
+		{name: "data.sqlite-journal", want: false},
+		{name: "upload.png", want: false},
+		{name: "app.log", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isRelevantFile(tt.name); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResolveUrls(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stderr)
+
+	apps := []app.App{
+		{Name: "alpha", Domains: []string{"shared.org"}},
+		{Name: "zeta", Domains: []string{"shared.org", "zeta.org"}},
+		{Name: "evil", Domains: []string{"example.com"}},
+		{Name: "plain", Url: "https://stale.org/"},
+	}
+
+	ResolveUrls(apps, "example.com", IndexDomains(apps, "example.com", ""))
+	want := []string{"https://shared.org/", "https://zeta.org/", "https://evil.example.com/", "https://plain.example.com/"}
+	for i, a := range apps {
+		if a.Url != want[i] {
+			t.Errorf("got url %q for %s, want %q", a.Url, a.Name, want[i])
+		}
+	}
+}
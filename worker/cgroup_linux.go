@@ -0,0 +1,208 @@
+//go:build linux
+
+package worker
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pomdtr/smallweb/app"
+	"golang.org/x/sys/unix"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cpuPeriod is the period of the cpu.max quota, in microseconds.
+const cpuPeriod = 100000
+
+var (
+	cgroupOnce       sync.Once
+	cgroupWorkersDir string
+	cgroupErr        error
+)
+
+// cgroup caps the cpu and memory of the worker processes of an app.
+type cgroup struct {
+	dir string
+	fd  *os.File
+}
+
+func newCgroup(name string, resources app.Resources) (*cgroup, error) {
+	cgroupOnce.Do(func() {
+		cgroupWorkersDir, cgroupErr = delegateCgroup()
+	})
+	if cgroupErr != nil {
+		return nil, cgroupErr
+	}
+
+	dir := filepath.Join(cgroupWorkersDir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create cgroup: %w", err)
+	}
+
+	memoryMax := "max"
+	if resources.MaxMemory > 0 {
+		memoryMax = strconv.Itoa(resources.MaxMemory * 1024 * 1024)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(memoryMax), 0644); err != nil {
+		return nil, fmt.Errorf("could not set memory limit: %w", err)
+	}
+
+	cpuMax := fmt.Sprintf("max %d", cpuPeriod)
+	if resources.MaxCPU > 0 {
+		cpuMax = fmt.Sprintf("%d %d", int(resources.MaxCPU*cpuPeriod), cpuPeriod)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(cpuMax), 0644); err != nil {
+		return nil, fmt.Errorf("could not set cpu limit: %w", err)
+	}
+
+	fd, err := os.Open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not open cgroup: %w", err)
+	}
+
+	return &cgroup{dir: dir, fd: fd}, nil
+}
+
+// delegateCgroup moves the processes of the smallweb cgroup to a leaf, so
+// that the cpu and memory controllers can be enabled for the workers (cgroup
+// v2 does not allow a cgroup with processes to distribute resources). It
+// returns the parent directory of the app cgroups.
+func delegateCgroup() (string, error) {
+	content, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", fmt.Errorf("could not read cgroup: %w", err)
+	}
+
+	var path string
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		if p, ok := strings.CutPrefix(line, "0::"); ok {
+			path = p
+		}
+	}
+
+	if path == "" {
+		return "", fmt.Errorf("cgroup v2 is not available")
+	}
+
+	dir := filepath.Join(cgroupRoot, path)
+	controllers, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return "", fmt.Errorf("could not read cgroup controllers: %w", err)
+	}
+
+	for _, controller := range []string{"cpu", "memory"} {
+		if !slices.Contains(strings.Fields(string(controllers)), controller) {
+			return "", fmt.Errorf("the %s controller is not delegated to smallweb", controller)
+		}
+	}
+
+	leaf := filepath.Join(dir, "smallweb")
+	if err := os.MkdirAll(leaf, 0755); err != nil {
+		return "", fmt.Errorf("could not create cgroup: %w", err)
+	}
+
+	procs, err := os.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return "", fmt.Errorf("could not read cgroup processes: %w", err)
+	}
+
+	for _, pid := range strings.Fields(string(procs)) {
+		if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(pid), 0644); err != nil {
+			return "", fmt.Errorf("could not move process %s to cgroup: %w", pid, err)
+		}
+	}
+
+	workersDir := filepath.Join(dir, "workers")
+	if err := os.MkdirAll(workersDir, 0755); err != nil {
+		return "", fmt.Errorf("could not create cgroup: %w", err)
+	}
+
+	for _, d := range []string{dir, workersDir} {
+		if err := os.WriteFile(filepath.Join(d, "cgroup.subtree_control"), []byte("+cpu +memory"), 0644); err != nil {
+			return "", fmt.Errorf("could not enable cgroup controllers: %w", err)
+		}
+	}
+
+	return workersDir, nil
+}
+
+// hasClone3 reports whether processes can be started directly in a cgroup,
+// which requires the clone3 syscall (linux 5.7). Called without arguments,
+// clone3 fails with EINVAL when it is available, and ENOSYS when it is not
+// implemented or blocked by seccomp.
+var hasClone3 = sync.OnceValue(func() bool {
+	_, _, errno := syscall.RawSyscall(unix.SYS_CLONE3, 0, 0, 0)
+	return errno != syscall.ENOSYS
+})
+
+// Start starts the command in the cgroup. Without clone3, the process is
+// moved to the cgroup right after it starts.
+func (me *cgroup) Start(cmd *exec.Cmd) error {
+	if me == nil {
+		return cmd.Start()
+	}
+
+	if !hasClone3() {
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(filepath.Join(me.dir, "cgroup.procs"), []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+			log.Printf("could not move process %d to cgroup: %v", cmd.Process.Pid, err)
+		}
+
+		return nil
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(me.fd.Fd())
+	return cmd.Start()
+}
+
+// OOMKills returns how many processes of the cgroup were killed for
+// exceeding the memory limit.
+func (me *cgroup) OOMKills() int {
+	if me == nil {
+		return 0
+	}
+
+	f, err := os.Open(filepath.Join(me.dir, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "oom_kill "); ok {
+			count, _ := strconv.Atoi(value)
+			return count
+		}
+	}
+
+	return 0
+}
+
+func (me *cgroup) Close() error {
+	if me == nil {
+		return nil
+	}
+
+	return me.fd.Close()
+}
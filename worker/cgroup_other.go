@@ -0,0 +1,30 @@
+//go:build !linux
+
+package worker
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/pomdtr/smallweb/app"
+)
+
+// cgroup is only supported on linux, memory and cpu caps are not enforced
+// on other platforms.
+type cgroup struct{}
+
+func newCgroup(name string, resources app.Resources) (*cgroup, error) {
+	return nil, fmt.Errorf("cgroups are only supported on linux")
+}
+
+func (me *cgroup) Start(cmd *exec.Cmd) error {
+	return cmd.Start()
+}
+
+func (me *cgroup) OOMKills() int {
+	return 0
+}
+
+func (me *cgroup) Close() error {
+	return nil
+}
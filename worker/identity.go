@@ -0,0 +1,56 @@
+package worker
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+const (
+	AuthMethodSession = "session"
+	AuthMethodToken   = "token"
+	AuthMethodCron    = "cron"
+)
+
+// Identity describes the caller authenticated by smallweb. It is forwarded
+// to the app using the X-Smallweb-* headers.
+type Identity struct {
+	Method  string
+	Email   string
+	TokenID string
+}
+
+type identityKey struct{}
+
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+// identityHeaders removes the X-Smallweb-* headers supplied by the client,
+// as apps must be able to trust them, and sets the ones of the caller.
+func identityHeaders(ctx context.Context, header http.Header) {
+	for key := range header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(key), "X-Smallweb-") {
+			header.Del(key)
+		}
+	}
+
+	identity, ok := IdentityFromContext(ctx)
+	if !ok {
+		return
+	}
+
+	header.Set("X-Smallweb-Auth-Method", identity.Method)
+	if identity.Email != "" {
+		header.Set("X-Smallweb-Email", identity.Email)
+	}
+
+	if identity.TokenID != "" {
+		header.Set("X-Smallweb-Token-Id", identity.TokenID)
+	}
+}
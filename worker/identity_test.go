@@ -0,0 +1,168 @@
+package worker
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/pomdtr/smallweb/app"
+)
+
+// newTestWorker returns a worker proxying requests to handler, which stands
+// in for the deno process of the app.
+func newTestWorker(t *testing.T, handler http.Handler) *Worker {
+	t.Helper()
+
+	// unix socket paths are limited in length, so t.TempDir is not used
+	dir, err := os.MkdirTemp("", "smallweb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	worker := NewWorker(app.App{Name: "test"}, nil)
+	worker.socketPath = filepath.Join(dir, "worker.sock")
+	listener, err := net.Listen("unix", worker.socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	worker.client = &http.Client{Transport: &http.Transport{DialContext: worker.dialContext}}
+	return worker
+}
+
+func smallwebHeaders(header http.Header) http.Header {
+	res := http.Header{}
+	for key, values := range header {
+		if strings.HasPrefix(key, "X-Smallweb-") && key != "X-Smallweb-Url" {
+			res[key] = values
+		}
+	}
+
+	return res
+}
+
+func TestWorkerStripsForgedIdentityHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity *Identity
+		want     http.Header
+	}{
+		{
+			name: "anonymous request",
+			want: http.Header{},
+		},
+		{
+			name:     "session",
+			identity: &Identity{Method: AuthMethodSession, Email: "pomdtr@example.com"},
+			want: http.Header{
+				"X-Smallweb-Auth-Method": {AuthMethodSession},
+				"X-Smallweb-Email":       {"pomdtr@example.com"},
+			},
+		},
+		{
+			name:     "token",
+			identity: &Identity{Method: AuthMethodToken, TokenID: "abcdefghijklmnop"},
+			want: http.Header{
+				"X-Smallweb-Auth-Method": {AuthMethodToken},
+				"X-Smallweb-Token-Id":    {"abcdefghijklmnop"},
+			},
+		},
+	}
+
+	forged := map[string]string{
+		"X-Smallweb-Auth-Method": AuthMethodSession,
+		"X-Smallweb-Email":       "admin@example.com",
+		"x-smallweb-token-id":    "forged",
+		"X-Smallweb-Admin":       "true",
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received http.Header
+			worker := newTestWorker(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r.Header.Clone()
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Host = "test.example.com"
+			for key, value := range forged {
+				r.Header[key] = []string{value}
+			}
+			if tt.identity != nil {
+				r = r.WithContext(WithIdentity(r.Context(), *tt.identity))
+			}
+
+			w := httptest.NewRecorder()
+			worker.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+			}
+
+			if got := smallwebHeaders(received); !headersEqual(got, tt.want) {
+				t.Errorf("app received %v, want %v", got, tt.want)
+			}
+
+			if got := received.Get("X-Smallweb-Url"); got != "https://test.example.com/" {
+				t.Errorf("app received url %q", got)
+			}
+		})
+	}
+}
+
+func TestWorkerStripsForgedIdentityHeadersFromWebsockets(t *testing.T) {
+	received := make(chan http.Header, 1)
+	worker := newTestWorker(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		worker.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), Identity{Method: AuthMethodToken, TokenID: "abcdefghijklmnop"})))
+	}))
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("X-Smallweb-Email", "admin@example.com")
+	header.Set("X-Smallweb-Auth-Method", AuthMethodSession)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	want := http.Header{
+		"X-Smallweb-Auth-Method": {AuthMethodToken},
+		"X-Smallweb-Token-Id":    {"abcdefghijklmnop"},
+	}
+	if got := smallwebHeaders(<-received); !headersEqual(got, want) {
+		t.Errorf("app received %v, want %v", got, want)
+	}
+}
+
+func headersEqual(a, b http.Header) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for key, values := range a {
+		if strings.Join(values, ",") != strings.Join(b[key], ",") {
+			return false
+		}
+	}
+
+	return true
+}
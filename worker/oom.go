@@ -0,0 +1,67 @@
+package worker
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+)
+
+// maxOOMLineLength is the length of the beginning of each line kept to
+// detect the V8 out of memory errors.
+const maxOOMLineLength = 256
+
+// v8OOMPrefixes are the beginnings of the lines printed by V8 when it runs
+// out of heap memory, right before aborting the process.
+var v8OOMPrefixes = [][]byte{
+	[]byte("Fatal JavaScript out of memory"),
+	[]byte("# Fatal JavaScript out of memory"),
+	[]byte("FATAL ERROR: Reached heap limit"),
+}
+
+// oomWriter forwards the stderr of the deno process, and detects the V8
+// out of memory errors. Only the fatal errors of V8 are matched, as the app
+// is free to log anything.
+type oomWriter struct {
+	io.Writer
+	outOfMemory atomic.Bool
+	line        []byte
+}
+
+func (me *oomWriter) Write(p []byte) (int, error) {
+	for chunk := p; len(chunk) > 0; {
+		end := bytes.IndexByte(chunk, '\n')
+		if end == -1 {
+			me.appendLine(chunk)
+			break
+		}
+
+		me.appendLine(chunk[:end])
+		me.checkLine()
+		chunk = chunk[end+1:]
+	}
+
+	return me.Writer.Write(p)
+}
+
+func (me *oomWriter) appendLine(p []byte) {
+	if room := maxOOMLineLength - len(me.line); room < len(p) {
+		p = p[:max(room, 0)]
+	}
+
+	me.line = append(me.line, p...)
+}
+
+func (me *oomWriter) checkLine() {
+	for _, prefix := range v8OOMPrefixes {
+		if bytes.HasPrefix(me.line, prefix) {
+			me.outOfMemory.Store(true)
+		}
+	}
+
+	me.line = me.line[:0]
+}
+
+// OutOfMemory reports whether the process ran out of heap memory.
+func (me *oomWriter) OutOfMemory() bool {
+	return me.outOfMemory.Load()
+}
@@ -0,0 +1,55 @@
+package worker
+
+import (
+	"io"
+	"testing"
+)
+
+func TestOOMWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   bool
+	}{
+		{
+			name:   "fatal error",
+			writes: []string{"\n<--- Last few GCs --->\n", "Fatal JavaScript out of memory: Reached heap limit\n"},
+			want:   true,
+		},
+		{
+			name:   "fatal error split across writes",
+			writes: []string{"Fatal JavaScript ", "out of memory: Ineffective mark-compacts near heap limit\n"},
+			want:   true,
+		},
+		{
+			name:   "fatal error with a hash prefix",
+			writes: []string{"#\n# Fatal JavaScript out of memory: Reached heap limit\n#\n"},
+			want:   true,
+		},
+		{
+			name:   "app logs",
+			writes: []string{"error: cache is out of memory\n", "warning: Fatal JavaScript out of memory\n"},
+			want:   false,
+		},
+		{
+			name:   "long line",
+			writes: []string{string(make([]byte, 1024)) + "Fatal JavaScript out of memory\n"},
+			want:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer := &oomWriter{Writer: io.Discard}
+			for _, write := range tt.writes {
+				if _, err := writer.Write([]byte(write)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := writer.OutOfMemory(); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package worker
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pomdtr/smallweb/app"
+)
+
+const evictInterval = 10 * time.Second
+
+// Pool keeps one long-lived worker per app. The worker is shared by
+// concurrent requests, and stopped once it has been idle for IdleTimeout.
+type Pool struct {
+	NewWorker   func(a app.App) (*Worker, error)
+	IdleTimeout time.Duration
+
+	mu      sync.Mutex
+	workers map[string]*Worker
+	// workers removed from the pool, but not stopped yet as they are still
+	// handling requests
+	draining map[*Worker]struct{}
+	stopping sync.WaitGroup
+	closed   bool
+	done     chan struct{}
+}
+
+func NewPool(newWorker func(a app.App) (*Worker, error), idleTimeout time.Duration) *Pool {
+	pool := &Pool{
+		NewWorker:   newWorker,
+		IdleTimeout: idleTimeout,
+		workers:     make(map[string]*Worker),
+		draining:    make(map[*Worker]struct{}),
+		done:        make(chan struct{}),
+	}
+
+	go pool.evictLoop()
+	return pool
+}
+
+// Get returns a running worker for the app, starting one if needed.
+// Every successful call must be matched by a call to Release.
+func (me *Pool) Get(a app.App) (*Worker, error) {
+	me.mu.Lock()
+	if me.closed {
+		me.mu.Unlock()
+		return nil, fmt.Errorf("worker pool is closed")
+	}
+
+	wk, ok := me.workers[a.Name]
+	if !ok {
+		var err error
+		if wk, err = me.NewWorker(a); err != nil {
+			me.mu.Unlock()
+			return nil, err
+		}
+
+		wk.ready = make(chan struct{})
+		me.workers[a.Name] = wk
+		go me.start(wk)
+	}
+	wk.activeRequests++
+	me.mu.Unlock()
+
+	<-wk.ready
+	if wk.startErr != nil {
+		me.Release(wk)
+		return nil, wk.startErr
+	}
+
+	return wk, nil
+}
+
+// Release marks a request handled by the worker as completed.
+func (me *Pool) Release(wk *Worker) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	wk.activeRequests--
+	wk.lastUsed = time.Now()
+	if wk.timedOut.Load() && !wk.draining {
+		// the app may be stuck, so it is restarted on the next request
+		log.Printf("recycling worker for %s after a timeout", wk.App.Name)
+		if me.workers[wk.App.Name] == wk {
+			delete(me.workers, wk.App.Name)
+		}
+		me.drain(wk)
+	}
+
+	if _, ok := me.draining[wk]; ok && wk.activeRequests == 0 {
+		delete(me.draining, wk)
+		me.stopAsync(wk)
+	}
+}
+
+// Invalidate removes the worker of an app from the pool. Requests already
+// handled by the worker are allowed to complete before it is stopped, while
+// new requests start a fresh worker.
+func (me *Pool) Invalidate(name string) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	wk, ok := me.workers[name]
+	if !ok {
+		return
+	}
+
+	delete(me.workers, name)
+	if wk.activeRequests == 0 {
+		wk.draining = true
+		me.stopAsync(wk)
+		return
+	}
+
+	me.drain(wk)
+}
+
+// drain marks a worker removed from the pool, so that it is stopped once its
+// last request completes. It must be called with the pool mutex held.
+func (me *Pool) drain(wk *Worker) {
+	wk.draining = true
+	me.draining[wk] = struct{}{}
+}
+
+// stopAsync stops a worker in the background. Close waits for it to
+// complete. It must be called with the pool mutex held.
+func (me *Pool) stopAsync(wk *Worker) {
+	me.stopping.Add(1)
+	go func() {
+		defer me.stopping.Done()
+		me.stop(wk)
+	}()
+}
+
+func (me *Pool) stop(wk *Worker) {
+	<-wk.ready
+	if wk.startErr != nil {
+		return
+	}
+
+	if err := wk.StopServer(); err != nil {
+		log.Printf("failed to stop worker for %s: %v", wk.App.Name, err)
+	}
+}
+
+func (me *Pool) start(wk *Worker) {
+	if err := wk.StartServer(); err != nil {
+		wk.startErr = err
+		close(wk.ready)
+		me.remove(wk)
+		return
+	}
+
+	close(wk.ready)
+	<-wk.Exited()
+	me.remove(wk)
+}
+
+func (me *Pool) remove(wk *Worker) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if me.workers[wk.App.Name] == wk {
+		delete(me.workers, wk.App.Name)
+	}
+}
+
+func (me *Pool) evictLoop() {
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-me.done:
+			return
+		case <-ticker.C:
+			me.evictIdle()
+		}
+	}
+}
+
+func (me *Pool) evictIdle() {
+	if me.IdleTimeout <= 0 {
+		return
+	}
+
+	me.mu.Lock()
+	var idle []*Worker
+	for name, wk := range me.workers {
+		select {
+		case <-wk.ready:
+		default:
+			continue
+		}
+
+		if wk.activeRequests > 0 || time.Since(wk.lastUsed) < me.IdleTimeout {
+			continue
+		}
+
+		delete(me.workers, name)
+		idle = append(idle, wk)
+	}
+	me.stopping.Add(len(idle))
+	me.mu.Unlock()
+
+	for _, wk := range idle {
+		me.stop(wk)
+		me.stopping.Done()
+	}
+}
+
+// Close stops every worker, including the ones draining their requests, and
+// waits for them to exit.
+func (me *Pool) Close() {
+	close(me.done)
+
+	me.mu.Lock()
+	me.closed = true
+	for _, wk := range me.workers {
+		me.stopAsync(wk)
+	}
+	for wk := range me.draining {
+		me.stopAsync(wk)
+	}
+	me.workers = make(map[string]*Worker)
+	me.draining = make(map[*Worker]struct{})
+	me.mu.Unlock()
+
+	me.stopping.Wait()
+}
@@ -0,0 +1,182 @@
+package worker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pomdtr/smallweb/app"
+)
+
+// newTestPool returns a pool whose workers run a fake deno executable, which
+// reports being ready and then waits to be interrupted.
+func newTestPool(t *testing.T) *Pool {
+	t.Helper()
+
+	deno := filepath.Join(t.TempDir(), "deno")
+	if err := os.WriteFile(deno, []byte("#!/bin/sh\necho READY\nexec sleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DENO_EXEC_PATH", deno)
+
+	return NewPool(func(a app.App) (*Worker, error) {
+		wk := NewWorker(a, map[string]string{"PATH": os.Getenv("PATH")})
+		wk.App.Dir = t.TempDir()
+		return wk, nil
+	}, time.Hour)
+}
+
+func waitExited(t *testing.T, wk *Worker) {
+	t.Helper()
+
+	select {
+	case <-wk.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("worker for %s did not exit", wk.App.Name)
+	}
+}
+
+func isExited(wk *Worker) bool {
+	select {
+	case <-wk.Exited():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestPoolStartsAndReusesWorkers(t *testing.T) {
+	pool := newTestPool(t)
+	defer pool.Close()
+
+	first, err := pool.Get(app.App{Name: "blog"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := pool.Get(app.App{Name: "blog"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Release(first)
+	pool.Release(second)
+
+	if first != second {
+		t.Errorf("concurrent requests should share the worker")
+	}
+
+	third, err := pool.Get(app.App{Name: "blog"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Release(third)
+
+	if third != first || isExited(first) {
+		t.Errorf("the worker should be kept warm between requests")
+	}
+
+	other, err := pool.Get(app.App{Name: "api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Release(other)
+
+	if other == first {
+		t.Errorf("each app should have its own worker")
+	}
+}
+
+func TestPoolEvictsIdleWorkers(t *testing.T) {
+	pool := newTestPool(t)
+	defer pool.Close()
+
+	idle, err := pool.Get(app.App{Name: "blog"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Release(idle)
+
+	busy, err := pool.Get(app.App{Name: "api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Release(busy)
+
+	pool.IdleTimeout = time.Millisecond
+	time.Sleep(10 * time.Millisecond)
+	pool.evictIdle()
+
+	waitExited(t, idle)
+	if isExited(busy) {
+		t.Errorf("a worker handling a request should not be evicted")
+	}
+
+	wk, err := pool.Get(app.App{Name: "blog"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Release(wk)
+
+	if wk == idle {
+		t.Errorf("a new worker should be started after an eviction")
+	}
+}
+
+func TestPoolInvalidateDrainsRequests(t *testing.T) {
+	pool := newTestPool(t)
+	defer pool.Close()
+
+	old, err := pool.Get(app.App{Name: "blog"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool.Invalidate("blog")
+	wk, err := pool.Get(app.App{Name: "blog"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Release(wk)
+
+	if wk == old {
+		t.Errorf("a new worker should be started after an invalidation")
+	}
+
+	if isExited(old) {
+		t.Fatalf("the old worker should complete its requests")
+	}
+
+	pool.Release(old)
+	waitExited(t, old)
+}
+
+func TestPoolCloseStopsEveryWorker(t *testing.T) {
+	pool := newTestPool(t)
+
+	running, err := pool.Get(app.App{Name: "api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Release(running)
+
+	draining, err := pool.Get(app.App{Name: "blog"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Invalidate("blog")
+
+	pool.Close()
+	for _, wk := range []*Worker{running, draining} {
+		if !isExited(wk) {
+			t.Errorf("worker for %s is still running after close", wk.App.Name)
+		}
+	}
+
+	// releasing the request interrupted by the shutdown is a no-op
+	pool.Release(draining)
+
+	if _, err := pool.Get(app.App{Name: "api"}); err == nil {
+		t.Errorf("a closed pool should not start workers")
+	}
+}
@@ -1,20 +1,16 @@
 const input = JSON.parse(Deno.args[0]);
 
 if (input.command === "fetch") {
-    const { entrypoint, port } = input;
-    const server = Deno.serve(
+    const { entrypoint, socket } = input;
+    Deno.serve(
         {
-            port: parseInt(port),
+            path: socket,
             onListen: () => {
                 // This line will signal that the server is ready to the go
                 console.log("READY");
             },
         },
         async (req) => {
-            // exit the server once the request will be handled
-            queueMicrotask(async () => {
-                await server.shutdown();
-            });
             try {
                 const mod = await import(entrypoint);
                 if (!mod.default) {
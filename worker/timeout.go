@@ -0,0 +1,98 @@
+package worker
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed timeout.html.tmpl
+var timeoutPageString string
+var timeoutPageTemplate = template.Must(template.New("timeout").Parse(timeoutPageString))
+
+// isTimeout reports whether the request to the worker failed because of a
+// timeout, either while waiting for the headers or the whole response.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (me *Worker) serveTimeoutPage(w http.ResponseWriter, r *http.Request, reason string) {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Error(w, fmt.Sprintf("app %s %s", me.App.Name, reason), http.StatusGatewayTimeout)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusGatewayTimeout)
+	timeoutPageTemplate.Execute(w, map[string]interface{}{
+		"App":    me.App.Name,
+		"Reason": reason,
+	})
+}
+
+// idleTimer cancels the request if the response body is not read for too
+// long. A nil timer is a no-op.
+type idleTimer struct {
+	timer   *time.Timer
+	timeout time.Duration
+	fired   chan struct{}
+}
+
+func newIdleTimer(timeout time.Duration, cancel context.CancelFunc) *idleTimer {
+	if timeout <= 0 {
+		return nil
+	}
+
+	var once sync.Once
+	fired := make(chan struct{})
+	return &idleTimer{
+		timeout: timeout,
+		fired:   fired,
+		timer: time.AfterFunc(timeout, func() {
+			once.Do(func() { close(fired) })
+			cancel()
+		}),
+	}
+}
+
+func (me *idleTimer) Reset() {
+	if me == nil {
+		return
+	}
+
+	me.timer.Reset(me.timeout)
+}
+
+func (me *idleTimer) Stop() {
+	if me == nil {
+		return
+	}
+
+	me.timer.Stop()
+}
+
+// Fired reports whether the request was cancelled by the timer.
+func (me *idleTimer) Fired() bool {
+	if me == nil {
+		return false
+	}
+
+	select {
+	case <-me.fired:
+		return true
+	default:
+		return false
+	}
+}
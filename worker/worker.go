@@ -2,11 +2,14 @@ package worker
 
 import (
 	"bufio"
+	"context"
 	"crypto"
 	_ "embed"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -14,11 +17,15 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/adrg/xdg"
 	"github.com/gorilla/websocket"
+	gonanoid "github.com/matoous/go-nanoid/v2"
 	"github.com/pomdtr/smallweb/app"
+	"github.com/pomdtr/smallweb/logs"
 	"github.com/pomdtr/smallweb/utils"
 )
 
@@ -43,10 +50,27 @@ func init() {
 }
 
 type Worker struct {
-	App  app.App
-	Env  map[string]string
-	port int
-	cmd  *exec.Cmd
+	App            app.App
+	Env            map[string]string
+	MaxPermissions app.Permissions
+	Denials        app.Denials
+	Timeouts       app.Timeouts
+	OnOOMKill      func(reason string)
+	Logs           *logs.Store
+	socketPath     string
+	client         *http.Client
+	cmd            *exec.Cmd
+	exited         chan struct{}
+
+	// bookkeeping used by the pool, guarded by the pool mutex
+	ready          chan struct{}
+	startErr       error
+	activeRequests int
+	lastUsed       time.Time
+	draining       bool
+
+	// set when a request timed out, the worker is then recycled by the pool
+	timedOut atomic.Bool
 }
 
 func NewWorker(app app.App, env map[string]string) *Worker {
@@ -70,17 +94,65 @@ func NewWorker(app app.App, env map[string]string) *Worker {
 
 var upgrader = websocket.Upgrader{} // use default options
 
-func (me *Worker) Flags() []string {
-	flags := []string{
-		"--allow-net",
-		"--allow-env",
-		"--allow-sys=osRelease,homedir,cpus,hostname",
+// Permissions returns the permissions granted to the app. Permissions
+// missing from the app config are restricted to the global ceiling, while an
+// app explicitly requesting more than allowed gets an error.
+func (me *Worker) Permissions() (app.Permissions, error) {
+	rootDir := filepath.Dir(me.App.Dir)
+	ceiling := me.MaxPermissions.Merge(app.DefaultPermissions).Resolve(rootDir)
+	requested := me.App.Config.Permissions.Resolve(me.App.Root())
+	if err := requested.Validate(ceiling, me.Denials.Resolve(rootDir)); err != nil {
+		return app.Permissions{}, err
+	}
+
+	return requested.Merge(app.DefaultPermissions.Intersect(ceiling)), nil
+}
+
+func (me *Worker) Flags() ([]string, error) {
+	permissions, err := me.Permissions()
+	if err != nil {
+		return nil, err
+	}
+
+	return me.flags(permissions), nil
+}
+
+func (me *Worker) flags(permissions app.Permissions, extraPaths ...string) []string {
+	var flags []string
+	flags = append(flags, permissionFlags("net", permissions.Net)...)
+	flags = append(flags, permissionFlags("env", permissions.Env)...)
+	flags = append(flags, permissionFlags("sys", permissions.Sys)...)
+	flags = append(flags,
 		"--unstable-kv",
 		"--no-prompt",
 		"--quiet",
 		fmt.Sprintf("--location=%s", me.App.Url),
-		fmt.Sprintf("--allow-read=%s,%s,%s", me.App.Root(), me.Env["DENO_DIR"], sandboxPath),
-		fmt.Sprintf("--allow-write=%s", me.App.Root()),
+	)
+
+	if permissions.Read.All {
+		flags = append(flags, "--allow-read")
+	} else {
+		paths := []string{me.App.Root(), me.Env["DENO_DIR"], sandboxPath}
+		paths = append(paths, extraPaths...)
+		paths = append(paths, permissions.Read.Values...)
+		flags = append(flags, fmt.Sprintf("--allow-read=%s", strings.Join(paths, ",")))
+	}
+
+	if permissions.Write.All {
+		flags = append(flags, "--allow-write")
+	} else {
+		paths := []string{me.App.Root()}
+		paths = append(paths, extraPaths...)
+		paths = append(paths, permissions.Write.Values...)
+		flags = append(flags, fmt.Sprintf("--allow-write=%s", strings.Join(paths, ",")))
+	}
+
+	flags = append(flags, permissionFlags("run", permissions.Run)...)
+	flags = append(flags, permissionFlags("ffi", permissions.Ffi)...)
+	flags = append(flags, me.Denials.Resolve(filepath.Dir(me.App.Dir)).Flags()...)
+
+	if heapSize := me.App.Config.Resources.MaxHeapSize; heapSize > 0 {
+		flags = append(flags, fmt.Sprintf("--v8-flags=--max-old-space-size=%d", heapSize))
 	}
 
 	if configPath := filepath.Join(me.App.Dir, "deno.json"); utils.FileExists(configPath) {
@@ -92,15 +164,61 @@ func (me *Worker) Flags() []string {
 	return flags
 }
 
+// environ returns the env of the deno process, without the denied variables.
+func (me *Worker) environ() []string {
+	var env []string
+	for _, vars := range []map[string]string{me.Env, me.App.Env} {
+		for k, v := range vars {
+			if me.Denials.DeniesEnv(k) {
+				continue
+			}
+
+			env = append(env, fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+
+	return env
+}
+
+func permissionFlags(name string, permission *app.Permission) []string {
+	if permission.All {
+		return []string{fmt.Sprintf("--allow-%s", name)}
+	}
+
+	if len(permission.Values) == 0 {
+		return nil
+	}
+
+	return []string{fmt.Sprintf("--allow-%s=%s", name, strings.Join(permission.Values, ","))}
+}
+
 func (me *Worker) StartServer() error {
-	port, err := GetFreePort()
+	permissions, err := me.Permissions()
 	if err != nil {
-		return fmt.Errorf("could not get free port: %w", err)
+		return err
+	}
+
+	// the server listens on a unix socket, so that it does not require any network permission
+	socketID, err := gonanoid.New()
+	if err != nil {
+		return fmt.Errorf("could not generate socket path: %w", err)
+	}
+	me.socketPath = filepath.Join(os.TempDir(), fmt.Sprintf("smallweb-%s.sock", socketID))
+	transport := &http.Transport{
+		DialContext: me.dialContext,
+	}
+	if me.Timeouts.Header > 0 {
+		transport.ResponseHeaderTimeout = time.Duration(me.Timeouts.Header)
+	}
+	me.client = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
 	}
-	me.port = port
 
 	args := []string{"run"}
-	args = append(args, me.Flags()...)
+	args = append(args, me.flags(permissions, me.socketPath)...)
 
 	input := strings.Builder{}
 	encoder := json.NewEncoder(&input)
@@ -108,7 +226,7 @@ func (me *Worker) StartServer() error {
 	encoder.Encode(map[string]any{
 		"command":    "fetch",
 		"entrypoint": me.App.Entrypoint(),
-		"port":       port,
+		"socket":     me.socketPath,
 	})
 	args = append(args, sandboxPath, input.String())
 
@@ -119,23 +237,37 @@ func (me *Worker) StartServer() error {
 
 	me.cmd = exec.Command(deno, args...)
 	me.cmd.Dir = me.App.Root()
-
-	var env []string
-	for k, v := range me.Env {
-		env = append(env, fmt.Sprintf("%s=%s", k, v))
-	}
-	for k, v := range me.App.Env {
-		env = append(env, fmt.Sprintf("%s=%s", k, v))
-	}
-	me.cmd.Env = env
+	me.cmd.Env = me.environ()
 
 	stdout, err := me.cmd.StdoutPipe()
 	if err != nil {
 		return fmt.Errorf("could not get stdout pipe: %w", err)
 	}
 
-	me.cmd.Stderr = os.Stderr
-	if err := me.cmd.Start(); err != nil {
+	// the output of the app is tagged and kept in its log, in addition to
+	// the output of smallweb
+	var stdoutWriter, stderrWriter io.Writer = os.Stdout, os.Stderr
+	closeLogs := func() {}
+	if me.Logs != nil {
+		stdoutLog := me.Logs.Writer(me.App.Name, logs.StreamStdout)
+		stderrLog := me.Logs.Writer(me.App.Name, logs.StreamStderr)
+		stdoutWriter = io.MultiWriter(os.Stdout, stdoutLog)
+		stderrWriter = io.MultiWriter(os.Stderr, stderrLog)
+		closeLogs = func() {
+			stdoutLog.Close()
+			stderrLog.Close()
+		}
+	}
+
+	stderr := &oomWriter{Writer: stderrWriter}
+	me.cmd.Stderr = stderr
+
+	cg := me.cgroup()
+	oomKills := cg.OOMKills()
+	err = cg.Start(me.cmd)
+	cg.Close()
+	if err != nil {
+		closeLogs()
 		return fmt.Errorf("could not start server: %w", err)
 	}
 
@@ -143,40 +275,91 @@ func (me *Worker) StartServer() error {
 	scanner.Scan()
 	line := scanner.Text()
 	if !(line == "READY") {
+		me.cmd.Process.Kill()
+		me.cmd.Wait()
+		closeLogs()
+		os.Remove(me.socketPath)
 		return fmt.Errorf("server did not start correctly")
 	}
 
+	me.exited = make(chan struct{})
 	go func() {
 		for scanner.Scan() {
-			os.Stdout.WriteString(scanner.Text() + "\n")
+			io.WriteString(stdoutWriter, scanner.Text()+"\n")
+		}
+
+		me.cmd.Wait()
+		closeLogs()
+		os.Remove(me.socketPath)
+
+		// the cgroup is shared with the commands of the app, so the kill
+		// is only attributed to the server if it received the SIGKILL
+		var reason string
+		if cg.OOMKills() > oomKills && killedBy(me.cmd.ProcessState, syscall.SIGKILL) {
+			reason = "memory limit exceeded"
+		} else if stderr.OutOfMemory() && !me.cmd.ProcessState.Success() {
+			reason = "heap limit exceeded"
 		}
+
+		if reason != "" {
+			log.Printf("worker for %s was killed: %s", me.App.Name, reason)
+			if me.OnOOMKill != nil {
+				me.OnOOMKill(reason)
+			}
+		}
+
+		close(me.exited)
 	}()
 
 	return nil
 }
 
+// cgroup returns the cgroup capping the memory and cpu of the app, or nil if
+// the app is not capped or cgroups are not available.
+func (me *Worker) cgroup() *cgroup {
+	resources := me.App.Config.Resources
+	if resources.MaxMemory <= 0 && resources.MaxCPU <= 0 {
+		return nil
+	}
+
+	cg, err := newCgroup(me.App.Name, resources)
+	if err != nil {
+		log.Printf("memory and cpu limits of %s are not enforced: %v", me.App.Name, err)
+		return nil
+	}
+
+	return cg
+}
+
+func killedBy(state *os.ProcessState, signal syscall.Signal) bool {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == signal
+}
+
+func (me *Worker) dialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "unix", me.socketPath)
+}
+
+// Exited returns a channel that is closed once the server process exits.
+func (me *Worker) Exited() <-chan struct{} {
+	return me.exited
+}
+
 func (me *Worker) StopServer() error {
 	if err := me.cmd.Process.Signal(os.Interrupt); err != nil {
 		log.Printf("Failed to send interrupt signal: %v", err)
 	}
 
-	done := make(chan error, 1)
-	go func() {
-		done <- me.cmd.Wait()
-	}()
-
 	select {
 	case <-time.After(5 * time.Second):
 		if err := me.cmd.Process.Kill(); err != nil {
 			return fmt.Errorf("failed to kill process: %w", err)
 		}
 
-		me.cmd = nil
-		me.port = 0
+		<-me.exited
 		return fmt.Errorf("process did not exit after 5 seconds")
-	case <-done:
-		me.cmd = nil
-		me.port = 0
+	case <-me.exited:
 		return nil
 	}
 }
@@ -193,7 +376,11 @@ func (me *Worker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		defer serverConn.Close()
 
-		clientConn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d%s", me.port, r.URL.Path), nil)
+		header := http.Header{}
+		identityHeaders(r.Context(), header)
+
+		dialer := websocket.Dialer{NetDialContext: me.dialContext}
+		clientConn, _, err := dialer.Dial(fmt.Sprintf("ws://worker%s", r.URL.Path), header)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -227,9 +414,27 @@ func (me *Worker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				break
 			}
 		}
+
+		return
+	}
+
+	ctx := r.Context()
+	isStreamingRoute := me.Timeouts.IsStreamingRoute(r.URL.Path)
+	if timeout := time.Duration(me.Timeouts.Request); timeout > 0 && !isStreamingRoute {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		// the server does not set a write timeout, as it would break streaming routes
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("failed to set write deadline: %v", err)
+		}
 	}
 
-	request, err := http.NewRequest(r.Method, fmt.Sprintf("http://localhost:%d%s", me.port, r.URL.String()), r.Body)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, r.Method, fmt.Sprintf("http://worker%s", r.URL.String()), r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -241,20 +446,28 @@ func (me *Worker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	identityHeaders(r.Context(), request.Header)
 	request.Header.Add("X-Smallweb-Url", url)
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
-
-	resp, err := client.Do(request)
+	resp, err := me.client.Do(request)
 	if err != nil {
+		if isTimeout(err) && r.Context().Err() == nil {
+			me.timedOut.Store(true)
+			log.Printf("app %s did not respond to %s %s in time: %v", me.App.Name, r.Method, r.URL.Path, err)
+			me.serveTimeoutPage(w, r, "did not respond in time")
+			return
+		}
+
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer resp.Body.Close()
 
+	var idle *idleTimer
+	if !isStreamingRoute {
+		idle = newIdleTimer(time.Duration(me.Timeouts.Idle), cancel)
+		defer idle.Stop()
+	}
+
 	for k, v := range resp.Header {
 		for _, vv := range v {
 			w.Header().Add(k, vv)
@@ -269,6 +482,7 @@ func (me *Worker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	for {
 		n, err := resp.Body.Read(buf)
 		if n > 0 {
+			idle.Reset()
 			_, writeErr := w.Write(buf[:n])
 			if writeErr != nil {
 				return
@@ -276,6 +490,11 @@ func (me *Worker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			flusher.Flush() // flush the buffer to the client
 		}
 		if err != nil {
+			// the headers are already sent, so the client only sees a truncated response
+			if idle.Fired() || (isTimeout(err) && r.Context().Err() == nil) {
+				me.timedOut.Store(true)
+				log.Printf("app %s did not complete the response to %s %s in time: %v", me.App.Name, r.Method, r.URL.Path, err)
+			}
 			break
 		}
 	}
@@ -314,8 +533,13 @@ func (me *Worker) Command(args ...string) (*exec.Cmd, error) {
 		args = []string{}
 	}
 
+	flags, err := me.Flags()
+	if err != nil {
+		return nil, err
+	}
+
 	denoArgs := []string{"run"}
-	denoArgs = append(denoArgs, me.Flags()...)
+	denoArgs = append(denoArgs, flags...)
 
 	input := strings.Builder{}
 	encoder := json.NewEncoder(&input)
@@ -333,27 +557,15 @@ func (me *Worker) Command(args ...string) (*exec.Cmd, error) {
 
 	cmd := exec.Command(deno, denoArgs...)
 	cmd.Dir = me.App.Root()
-	for k, v := range me.Env {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
-	}
-	for k, v := range me.App.Env {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
-	}
+	cmd.Env = me.environ()
 
 	return cmd, nil
 }
 
-// GetFreePort asks the kernel for a free open port that is ready to use.
-func GetFreePort() (int, error) {
-	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
-	if err != nil {
-		return 0, err
-	}
+// Start starts a command created by Command, in the cgroup of the app.
+func (me *Worker) Start(cmd *exec.Cmd) error {
+	cg := me.cgroup()
+	defer cg.Close()
 
-	l, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		return 0, err
-	}
-	defer l.Close()
-	return l.Addr().(*net.TCPAddr).Port, nil
+	return cg.Start(cmd)
 }